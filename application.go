@@ -2,8 +2,16 @@ package main
 
 import (
 	"bitbucket-cascade-merge/internal"
+	"context"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/ktrysmt/go-bitbucket"
@@ -17,7 +25,21 @@ func main() {
 	password := os.Getenv("BITBUCKET_PASSWORD")
 	releaseBranchPrefix := os.Getenv("RELEASE_BRANCH_PREFIX")
 	developmentBranchName := os.Getenv("DEVELOPMENT_BRANCH_NAME")
+	workspace := os.Getenv("BITBUCKET_WORKSPACE")
 	bitbucketSharedKey := os.Getenv("BITBUCKET_SHARED_KEY")
+	webhookSecrets := os.Getenv("BITBUCKET_WEBHOOK_SECRETS")
+	cascadeConfigPath := os.Getenv("CASCADE_CONFIG")
+	dataDir := os.Getenv("DATA_DIR")
+	queueWorkers := os.Getenv("QUEUE_WORKERS")
+	queueMaxAttempts := os.Getenv("QUEUE_MAX_ATTEMPTS")
+	dedupWindow := os.Getenv("DEDUP_WINDOW")
+	branchCacheTTL := os.Getenv("BRANCH_CACHE_TTL")
+	rateLimit := os.Getenv("BITBUCKET_RATE_LIMIT")
+	maxRetries := os.Getenv("BITBUCKET_MAX_RETRIES")
+	dryRun := os.Getenv("DRY_RUN")
+	reconcileInterval := os.Getenv("RECONCILE_INTERVAL")
+	releaseTrain := os.Getenv("RELEASE_TRAIN")
+	adminToken := os.Getenv("ADMIN_TOKEN")
 
 	if port == "" {
 		log.Fatal("$PORT must be set")
@@ -34,17 +56,76 @@ func main() {
 	if developmentBranchName == "" {
 		log.Fatal("DEVELOPMENT_BRANCH_NAME must be set. See README.md")
 	}
-	if bitbucketSharedKey == "" {
-		log.Fatal("BITBUCKET_SHARED_KEY must be set. See README.md")
+	if webhookSecrets == "" && bitbucketSharedKey == "" {
+		log.Fatal("BITBUCKET_WEBHOOK_SECRETS (or legacy BITBUCKET_SHARED_KEY) must be set. See README.md")
+	}
+	if bitbucketSharedKey != "" {
+		log.Println("WARNING: legacy BITBUCKET_SHARED_KEY query parameter validation is enabled")
+	}
+	if dataDir == "" {
+		// The dyno filesystem, /tmp included, is wiped on every restart
+		if os.Getenv("DYNO") != "" {
+			log.Fatal("DATA_DIR must be set to a persistent volume on Heroku. See README.md")
+		}
+		dataDir = filepath.Join(os.TempDir(), "bitbucket-cascade-merge")
+	}
+
+	registry, err := internal.LoadCascadeRegistry(cascadeConfigPath, internal.RepositorySettings{
+		DevelopmentBranchName: developmentBranchName,
+		ReleaseBranchPrefix:   releaseBranchPrefix,
+		AutoMerge:             true,
+		DryRun:                dryRun == "true",
+		ConflictMarker:        "[CONFLICT]",
+		ConflictBranches:      true,
+		ReleaseTrain:          releaseTrain == "true",
+		Reviewers:             internal.ReviewerSettings{Author: true, Approvers: true, CodeOwnersPath: "CODEOWNERS"},
+	})
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	bitbucketClient := bitbucket.NewBasicAuth(username, password)
+	budget := internal.NewRequestBudget(intOrDefault(rateLimit, 1000), workspace)
+	bitbucketClient.HttpClient.Transport = internal.NewRetryTransport(http.DefaultTransport, budget, intOrDefault(maxRetries, 4))
 	/* API KEY ATTEMPT
 	ctx := context.Background()
 	bitbucketClient, err := apikeys.NewService(ctx, option.WithAPIKey(password)) */
 
-	bitbucketService := internal.NewBitbucketService(bitbucketClient, releaseBranchPrefix, developmentBranchName)
-	bitbucketController := internal.NewBitbucketController(bitbucketService, bitbucketSharedKey)
+	bitbucketAPI := internal.NewMetricsAPI(internal.NewBitbucketAPI(bitbucketClient, username, password, workspace))
+	branchCache := internal.NewBranchCache(durationOrDefault(branchCacheTTL, 5*time.Minute))
+	blocked, err := internal.NewBlockedStore(filepath.Join(dataDir, "blocked.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	cascades, err := internal.NewCascadeStore(filepath.Join(dataDir, "cascades.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	reconcileStore, err := internal.NewReconcileStore(filepath.Join(dataDir, "reconcile.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	bitbucketService := internal.NewBitbucketService(bitbucketAPI, registry, branchCache, blocked, cascades, reconcileStore)
+	jobQueue, err := internal.NewJobQueue(filepath.Join(dataDir, "queue"), intOrDefault(queueWorkers, 4), intOrDefault(queueMaxAttempts, 8), 5*time.Second)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	deliveries, err := internal.NewDeliveryStore(filepath.Join(dataDir, "deliveries.json"), durationOrDefault(dedupWindow, 24*time.Hour))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	bitbucketController := internal.NewBitbucketController(bitbucketService, jobQueue, deliveries, splitList(webhookSecrets), bitbucketSharedKey, adminToken)
+
+	internal.NewGaugeFunc("cascade_job_queue_depth", "Webhook deliveries queued or waiting to be retried.", func() float64 {
+		return float64(jobQueue.Depth())
+	})
+	if err := jobQueue.Start(bitbucketController.Process); err != nil {
+		log.Fatal(err)
+	}
+	reconciler := internal.NewReconciler(bitbucketService, jobQueue, durationOrDefault(reconcileInterval, 30*time.Minute))
+	reconciler.Start()
 
 	router := gin.New()
 	router.Use(gin.Logger())
@@ -52,6 +133,72 @@ func main() {
 	router.GET("/", func(c *gin.Context) {
 		c.JSON(200, nil)
 	})
+	router.GET("/plan", bitbucketController.Plan)
+	//They list repositories, branches and authors
+	admin := router.Group("/", bitbucketController.RequireAdmin)
+	admin.GET("/plans", bitbucketController.Plans)
+	admin.GET("/drift", bitbucketController.Drift)
+	admin.GET("/blocked", bitbucketController.Blocked)
+	admin.GET("/cascades/:id", bitbucketController.Cascade)
+	admin.GET("/dashboard", bitbucketController.Dashboard)
+	router.GET("/metrics", gin.WrapF(internal.MetricsHandler))
 
-	_ = router.Run(":" + port)
+	server := &http.Server{
+		Addr:    ":" + port,
+		Handler: router,
+	}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// Heroku sends SIGTERM and allows 30 seconds before SIGKILL
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGTERM, os.Interrupt)
+	<-quit
+	log.Println("Shutting down...")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("HTTP server shutdown: ", err)
+	}
+	reconciler.Stop()
+	jobQueue.Stop(20 * time.Second)
+}
+
+// splitList splits a comma separated environment variable, dropping blanks
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// intOrDefault parses an integer environment variable, exiting on garbage
+func intOrDefault(value string, fallback int) int {
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatal("Invalid number: ", value)
+	}
+	return n
+}
+
+// durationOrDefault parses a duration environment variable such as "24h", exiting on garbage
+func durationOrDefault(value string, fallback time.Duration) time.Duration {
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatal("Invalid duration: ", value)
+	}
+	return d
 }
@@ -11,4 +11,5 @@ require (
 	github.com/stretchr/testify v1.8.2 // indirect
 	golang.org/x/mod v0.10.0
 	gopkg.in/bluesuncorp/validator.v5 v5.10.3 // indirect
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,407 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/ktrysmt/go-bitbucket"
+)
+
+// BitbucketAPI is the part of the Bitbucket Cloud API the cascade logic depends on. Repositories
+// are addressed the same way the webhook payloads do: owner (workspace slug or UUID) and repo slug.
+type BitbucketAPI interface {
+	// ListBranches returns every branch whose name contains (case insensitive) one of nameFilter, or all branches when empty
+	ListBranches(repoOwner string, repoSlug string, nameFilter []string) ([]BranchRef, error)
+	ListPullRequests(repoOwner string, repoSlug string, filter PullRequestFilter) ([]PullRequest, error)
+	GetPullRequest(repoOwner string, repoSlug string, pullRequestId int64) (*PullRequest, error)
+	CreatePullRequest(repoOwner string, repoSlug string, options PullRequestOptions) (*PullRequest, error)
+	ApprovePullRequest(repoOwner string, repoSlug string, pullRequestId int64) error
+	MergePullRequest(repoOwner string, repoSlug string, pullRequestId int64, options MergeOptions) error
+	PostComment(repoOwner string, repoSlug string, pullRequestId int64, content string) error
+	GetCommitStatuses(repoOwner string, repoSlug string, commitHash string) ([]CommitStatus, error)
+	// ListCommits returns the commits reachable from include but not from exclude (branch names or hashes), newest first
+	ListCommits(repoOwner string, repoSlug string, include string, exclude string) ([]Commit, error)
+	// GetDiffStat returns the changed files of a pull request, including the ones in conflict
+	GetDiffStat(repoOwner string, repoSlug string, pullRequestId int64) ([]DiffStat, error)
+	UpdatePullRequest(repoOwner string, repoSlug string, pullRequestId int64, update PullRequestUpdate) error
+	DeclinePullRequest(repoOwner string, repoSlug string, pullRequestId int64) error
+	CreateBranch(repoOwner string, repoSlug string, name string, commitHash string) error
+	// CurrentUser returns the account the API is used with
+	CurrentUser() (*Owner, error)
+	// GetFileContent returns a file as of ref (a branch name or commit hash)
+	GetFileContent(repoOwner string, repoSlug string, ref string, path string) ([]byte, error)
+}
+
+// PullRequestFilter narrows ListPullRequests, empty fields match anything
+type PullRequestFilter struct {
+	State             string
+	SourceBranch      string
+	DestinationBranch string
+	TitleContains     string
+}
+
+// PullRequestOptions describes a pull request to create
+type PullRequestOptions struct {
+	Title             string
+	Description       string
+	SourceBranch      string
+	DestinationBranch string
+	// Reviewers are account IDs, or UUIDs in braces
+	Reviewers         []string
+	CloseSourceBranch bool
+}
+
+// MergeOptions customises a merge, empty fields use the Bitbucket defaults
+type MergeOptions struct {
+	// Strategy is merge_commit, squash or fast_forward
+	Strategy string
+	Message  string
+}
+
+// PullRequestUpdate lists the fields of a pull request to change, empty fields are left alone
+type PullRequestUpdate struct {
+	Title string
+	// Reviewers replaces the reviewers, account IDs or UUIDs in braces
+	Reviewers []string
+}
+
+// Matches applies the filter to a pull request, the in-memory equivalent of Query
+func (filter PullRequestFilter) Matches(pr *PullRequest) bool {
+	return (filter.State == "" || pr.State == filter.State) &&
+		(filter.SourceBranch == "" || pr.Source.Branch.Name == filter.SourceBranch) &&
+		(filter.DestinationBranch == "" || pr.Destination.Branch.Name == filter.DestinationBranch) &&
+		(filter.TitleContains == "" || strings.Contains(pr.Title, filter.TitleContains))
+}
+
+// Query renders the filter as a Bitbucket query language expression
+func (filter PullRequestFilter) Query() string {
+	var clauses []string
+	if filter.TitleContains != "" {
+		clauses = append(clauses, "title ~ "+strconv.Quote(filter.TitleContains))
+	}
+	if filter.State != "" {
+		clauses = append(clauses, "state = "+strconv.Quote(filter.State))
+	}
+	if filter.DestinationBranch != "" {
+		clauses = append(clauses, "destination.branch.name = "+strconv.Quote(filter.DestinationBranch))
+	}
+	if filter.SourceBranch != "" {
+		clauses = append(clauses, "source.branch.name = "+strconv.Quote(filter.SourceBranch))
+	}
+	return strings.Join(clauses, " AND ")
+}
+
+// goBitbucketAPI implements BitbucketAPI with go-bitbucket, plus hand rolled requests for the
+// endpoints the library doesn't cover well
+type goBitbucketAPI struct {
+	client   *bitbucket.Client
+	username string
+	password string
+	// workspace replaces the repository owner on the hand rolled requests when set
+	workspace string
+}
+
+func NewBitbucketAPI(client *bitbucket.Client, username string, password string, workspace string) BitbucketAPI {
+	return &goBitbucketAPI{client, username, password, workspace}
+}
+
+func (api *goBitbucketAPI) ListBranches(repoOwner string, repoSlug string, nameFilter []string) ([]BranchRef, error) {
+	query := url.Values{}
+	query.Set("pagelen", "100")
+	if len(nameFilter) > 0 {
+		clauses := make([]string, len(nameFilter))
+		for i, name := range nameFilter {
+			clauses[i] = "name ~ " + strconv.Quote(name)
+		}
+		query.Set("q", strings.Join(clauses, " OR "))
+	}
+	next := api.repositoryURL(repoOwner, repoSlug) + "/refs/branches?" + query.Encode()
+
+	// Follow the "next" links, pagelen is capped at 100
+	var branches []BranchRef
+	for next != "" {
+		var result BranchesPayload
+		if err := api.do("GET", next, nil, &result); err != nil {
+			return nil, NewUpstreamError("ListBranches", err)
+		}
+		branches = append(branches, result.Values...)
+		next = result.Next
+	}
+	return branches, nil
+}
+
+func (api *goBitbucketAPI) ListPullRequests(repoOwner string, repoSlug string, filter PullRequestFilter) ([]PullRequest, error) {
+	options := bitbucket.PullRequestsOptions{
+		Owner:    repoOwner,
+		RepoSlug: repoSlug,
+		Query:    filter.Query(),
+	}
+	if filter.State != "" {
+		options.States = []string{filter.State}
+	}
+
+	resp, err := api.client.Repositories.PullRequests.Gets(&options)
+	if err != nil {
+		return nil, NewUpstreamError("ListPullRequests", err)
+	}
+
+	var result struct {
+		Values []PullRequest `json:"values"`
+	}
+	if err := decodeResponse(resp, &result); err != nil {
+		return nil, NewUpstreamError("ListPullRequests", err)
+	}
+	return result.Values, nil
+}
+
+func (api *goBitbucketAPI) GetPullRequest(repoOwner string, repoSlug string, pullRequestId int64) (*PullRequest, error) {
+	endpoint := api.repositoryURL(repoOwner, repoSlug) + "/pullrequests/" + strconv.FormatInt(pullRequestId, 10)
+
+	var pr PullRequest
+	if err := api.do("GET", endpoint, nil, &pr); err != nil {
+		return nil, NewUpstreamError("GetPullRequest", err)
+	}
+	return &pr, nil
+}
+
+// go-bitbucket only takes reviewer UUIDs, the origin of a cascade only knows account IDs
+func (api *goBitbucketAPI) CreatePullRequest(repoOwner string, repoSlug string, options PullRequestOptions) (*PullRequest, error) {
+	endpoint := api.repositoryURL(repoOwner, repoSlug) + "/pullrequests"
+	body := map[string]interface{}{
+		"title":               options.Title,
+		"description":         options.Description,
+		"source":              map[string]interface{}{"branch": map[string]string{"name": options.SourceBranch}},
+		"destination":         map[string]interface{}{"branch": map[string]string{"name": options.DestinationBranch}},
+		"close_source_branch": options.CloseSourceBranch,
+		"reviewers":           reviewerRefs(options.Reviewers),
+	}
+
+	var pr PullRequest
+	if err := api.do("POST", endpoint, body, &pr); err != nil {
+		return nil, NewUpstreamError("CreatePullRequest", err)
+	}
+	return &pr, nil
+}
+
+// HACK: go-bitbucket approves against the owner, which stopped working after switching workspace
+func (api *goBitbucketAPI) ApprovePullRequest(repoOwner string, repoSlug string, pullRequestId int64) error {
+	endpoint := api.repositoryURL(repoOwner, repoSlug) + "/pullrequests/" + strconv.FormatInt(pullRequestId, 10) + "/approve"
+	err := api.do("POST", endpoint, nil, nil)
+
+	// 409 Conflict: already approved by this user
+	var statusErr *bitbucket.UnexpectedResponseStatusError
+	if errors.As(err, &statusErr) && strings.HasPrefix(statusErr.Status, "409") {
+		return nil
+	}
+	return NewUpstreamError("ApprovePullRequest", err)
+}
+
+// go-bitbucket can't pass a merge strategy
+func (api *goBitbucketAPI) MergePullRequest(repoOwner string, repoSlug string, pullRequestId int64, options MergeOptions) error {
+	endpoint := api.repositoryURL(repoOwner, repoSlug) + "/pullrequests/" + strconv.FormatInt(pullRequestId, 10) + "/merge"
+
+	body := map[string]interface{}{"type": "pullrequest"}
+	if options.Strategy != "" {
+		body["merge_strategy"] = options.Strategy
+	}
+	if options.Message != "" {
+		body["message"] = options.Message
+	}
+	return NewUpstreamError("MergePullRequest", api.do("POST", endpoint, body, nil))
+}
+
+func (api *goBitbucketAPI) PostComment(repoOwner string, repoSlug string, pullRequestId int64, content string) error {
+	_, err := api.client.Repositories.PullRequests.AddComment(&bitbucket.PullRequestCommentOptions{
+		Owner:         repoOwner,
+		RepoSlug:      repoSlug,
+		PullRequestID: strconv.FormatInt(pullRequestId, 10),
+		Content:       content,
+	})
+	return NewUpstreamError("PostComment", err)
+}
+
+func (api *goBitbucketAPI) GetCommitStatuses(repoOwner string, repoSlug string, commitHash string) ([]CommitStatus, error) {
+	endpoint := api.repositoryURL(repoOwner, repoSlug) + "/commit/" + commitHash + "/statuses?pagelen=100"
+
+	var result struct {
+		Values []CommitStatus `json:"values"`
+	}
+	if err := api.do("GET", endpoint, nil, &result); err != nil {
+		return nil, NewUpstreamError("GetCommitStatuses", err)
+	}
+	return result.Values, nil
+}
+
+// maxCommitPages bounds ListCommits, a stage that far behind needs a human anyway
+const maxCommitPages = 10
+
+func (api *goBitbucketAPI) ListCommits(repoOwner string, repoSlug string, include string, exclude string) ([]Commit, error) {
+	query := url.Values{}
+	query.Set("pagelen", "100")
+	query.Set("include", include)
+	query.Set("exclude", exclude)
+	next := api.repositoryURL(repoOwner, repoSlug) + "/commits?" + query.Encode()
+
+	var commits []Commit
+	for page := 0; next != "" && page < maxCommitPages; page++ {
+		var result struct {
+			Values []Commit `json:"values"`
+			Next   string   `json:"next"`
+		}
+		if err := api.do("GET", next, nil, &result); err != nil {
+			return nil, NewUpstreamError("ListCommits", err)
+		}
+		commits = append(commits, result.Values...)
+		next = result.Next
+	}
+	return commits, nil
+}
+
+func (api *goBitbucketAPI) GetDiffStat(repoOwner string, repoSlug string, pullRequestId int64) ([]DiffStat, error) {
+	next := api.repositoryURL(repoOwner, repoSlug) + "/pullrequests/" + strconv.FormatInt(pullRequestId, 10) + "/diffstat?pagelen=500"
+
+	var diffStats []DiffStat
+	for next != "" {
+		var result struct {
+			Values []DiffStat `json:"values"`
+			Next   string     `json:"next"`
+		}
+		if err := api.do("GET", next, nil, &result); err != nil {
+			return nil, NewUpstreamError("GetDiffStat", err)
+		}
+		diffStats = append(diffStats, result.Values...)
+		next = result.Next
+	}
+	return diffStats, nil
+}
+
+func (api *goBitbucketAPI) UpdatePullRequest(repoOwner string, repoSlug string, pullRequestId int64, update PullRequestUpdate) error {
+	endpoint := api.repositoryURL(repoOwner, repoSlug) + "/pullrequests/" + strconv.FormatInt(pullRequestId, 10)
+
+	body := map[string]interface{}{}
+	if update.Title != "" {
+		body["title"] = update.Title
+	}
+	if update.Reviewers != nil {
+		body["reviewers"] = reviewerRefs(update.Reviewers)
+	}
+	return NewUpstreamError("UpdatePullRequest", api.do("PUT", endpoint, body, nil))
+}
+
+func (api *goBitbucketAPI) DeclinePullRequest(repoOwner string, repoSlug string, pullRequestId int64) error {
+	endpoint := api.repositoryURL(repoOwner, repoSlug) + "/pullrequests/" + strconv.FormatInt(pullRequestId, 10) + "/decline"
+	return NewUpstreamError("DeclinePullRequest", api.do("POST", endpoint, nil, nil))
+}
+
+func (api *goBitbucketAPI) CreateBranch(repoOwner string, repoSlug string, name string, commitHash string) error {
+	endpoint := api.repositoryURL(repoOwner, repoSlug) + "/refs/branches"
+	body := map[string]interface{}{
+		"name":   name,
+		"target": map[string]string{"hash": commitHash},
+	}
+	return NewUpstreamError("CreateBranch", api.do("POST", endpoint, body, nil))
+}
+
+func (api *goBitbucketAPI) CurrentUser() (*Owner, error) {
+	var user Owner
+	if err := api.do("GET", api.client.GetApiBaseURL()+"/user", nil, &user); err != nil {
+		return nil, NewUpstreamError("CurrentUser", err)
+	}
+	return &user, nil
+}
+
+func (api *goBitbucketAPI) GetFileContent(repoOwner string, repoSlug string, ref string, path string) ([]byte, error) {
+	endpoint := api.repositoryURL(repoOwner, repoSlug) + "/src/" + url.PathEscape(ref) + "/" + strings.TrimPrefix(path, "/")
+
+	var content []byte
+	if err := api.do("GET", endpoint, nil, &content); err != nil {
+		return nil, NewUpstreamError("GetFileContent", err)
+	}
+	return content, nil
+}
+
+// reviewerRefs turns reviewer IDs into the user objects of the pull request API
+func reviewerRefs(reviewers []string) []map[string]string {
+	refs := make([]map[string]string, 0, len(reviewers))
+	for _, reviewer := range reviewers {
+		if strings.HasPrefix(reviewer, "{") {
+			refs = append(refs, map[string]string{"uuid": reviewer})
+		} else {
+			refs = append(refs, map[string]string{"account_id": reviewer})
+		}
+	}
+	return refs
+}
+
+func (api *goBitbucketAPI) repositoryURL(repoOwner string, repoSlug string) string {
+	owner := repoOwner
+	if api.workspace != "" {
+		owner = api.workspace
+	}
+	return api.client.GetApiBaseURL() + "/repositories/" + owner + "/" + repoSlug
+}
+
+// do sends a basic auth request with in as JSON body when given, decoding a JSON response into out when given.
+// A *[]byte out receives the raw response.
+func (api *goBitbucketAPI) do(method string, endpoint string, in interface{}, out interface{}) error {
+	log.Println(method, endpoint)
+	var body io.Reader
+	if in != nil {
+		buf, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(buf)
+	}
+	req, err := http.NewRequest(method, endpoint, body)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(api.username, api.password)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	response, err := api.client.HttpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	respBody, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode >= 300 {
+		return &bitbucket.UnexpectedResponseStatusError{Status: response.Status, Body: respBody}
+	}
+	if out == nil {
+		return nil
+	}
+	if raw, ok := out.(*[]byte); ok {
+		*raw = respBody
+		return nil
+	}
+	if err := json.Unmarshal(respBody, out); err != nil {
+		return fmt.Errorf("can not unmarshal JSON: %v", err)
+	}
+	return nil
+}
+
+// decodeResponse converts go-bitbucket's generic map response into a typed struct
+func decodeResponse(resp interface{}, out interface{}) error {
+	buf, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, out)
+}
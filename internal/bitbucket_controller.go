@@ -1,7 +1,13 @@
 package internal
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -11,10 +17,22 @@ import (
 )
 
 type BitbucketController struct {
-	bitbucketService   *BitbucketService
+	bitbucketService *BitbucketService
+	jobQueue         *JobQueue
+	deliveries       *DeliveryStore
+	// WebhookSecrets verify the X-Hub-Signature header; more than one allows rotating secrets
+	WebhookSecrets []string
+	// BitbucketSharedKey enables the legacy ?key= query parameter check when set
 	BitbucketSharedKey string
+	// AdminToken is the bearer token of the on demand endpoints reading Bitbucket, they are disabled when empty
+	AdminToken string
 }
 
+const SignatureHeader = "X-Hub-Signature"
+const RequestUUIDHeader = "X-Request-UUID"
+const HookUUIDHeader = "X-Hook-UUID"
+const signaturePrefix = "sha256="
+
 const PrFufilled = "pullrequest:fulfilled"
 
 // NB!!! Revert to above again after testing!
@@ -22,53 +40,90 @@ const PrFufilled = "pullrequest:fulfilled"
 
 const PrCommentTrigger = "pullrequest:comment_created"
 
-func NewBitbucketController(bitbucketService *BitbucketService, bitbucketSharedKey string) *BitbucketController {
-	return &BitbucketController{bitbucketService, bitbucketSharedKey}
+const RepoPush = "repo:push"
+
+// knownEvents are the X-Event-Key values of the webhook triggers, counted by key. Anything else is
+// counted as "other" so a client can't grow the metric without bound.
+var knownEvents = map[string]bool{
+	"pullrequest:created":                 true,
+	"pullrequest:updated":                 true,
+	"pullrequest:approved":                true,
+	"pullrequest:unapproved":              true,
+	PrFufilled:                            true,
+	"pullrequest:rejected":                true,
+	PrCommentTrigger:                      true,
+	"pullrequest:comment_updated":         true,
+	"pullrequest:comment_deleted":         true,
+	"pullrequest:changes_request_created": true,
+	"pullrequest:changes_request_removed": true,
+	RepoPush:                              true,
+	RepoCommitStatusCreated:               true,
+	RepoCommitStatusUpdated:               true,
 }
 
-func (ctrl *BitbucketController) Webhook(c *gin.Context) {
+// eventLabel is the event_key label of a webhook delivery
+func eventLabel(eventKey string) string {
+	if knownEvents[eventKey] {
+		return eventKey
+	}
+	return "other"
+}
 
-	var PullRequestPayload PullRequestMergedPayload
+func NewBitbucketController(bitbucketService *BitbucketService, jobQueue *JobQueue, deliveries *DeliveryStore, webhookSecrets []string, bitbucketSharedKey string, adminToken string) *BitbucketController {
+	return &BitbucketController{bitbucketService, jobQueue, deliveries, webhookSecrets, bitbucketSharedKey, adminToken}
+}
 
-	buf, err := ioutil.ReadAll(c.Request.Body)
-	if err != nil {
-		log.Fatal(err)
-	}
+func (ctrl *BitbucketController) Webhook(c *gin.Context) {
 
-	err = json.Unmarshal(buf, &PullRequestPayload)
+	buf, err := ioutil.ReadAll(c.Request.Body)
 	if err != nil {
-		log.Fatal(err)
+		log.Println("Could not read webhook body: ", err)
+		c.JSON(http.StatusBadRequest, nil)
+		return
 	}
 
-	log.Println("c.Request.Header.Get(X-Event-Key): ", c.Request.Header.Get("X-Event-Key"))
-
-	if ctrl.validate(c.Request) {
-		go func() {
-			var err error
-			var PrForceRetrigger bool
-
-			// Detect a force-retrigger
-			if c.Request.Header.Get("X-Event-Key") == PrCommentTrigger {
-				log.Println("In Detect a force-retrigger. Comment=", PullRequestPayload.Comment.Content.Raw)
+	eventKey := c.Request.Header.Get("X-Event-Key")
+	log.Println("c.Request.Header.Get(X-Event-Key): ", eventKey)
 
-				// Only counts if comment = "#AutoCascade or new Jira editor is `#AutoCascade`"
-				if strings.TrimSpace(PullRequestPayload.Comment.Content.Raw) == "#AutoCascade" || strings.TrimSpace(PullRequestPayload.Comment.Content.Raw) == "`#AutoCascade`" || strings.TrimSpace(PullRequestPayload.Comment.Content.Raw) == "\\#AutoCascade" {
-					log.Println("In Set PrForceRetrigger = true")
-					PrForceRetrigger = true
-				}
+	if ctrl.validate(c.Request, buf) {
+		//Only authenticated deliveries are counted
+		WebhookEvents.Inc(eventLabel(eventKey))
+		if _, err = parsePayload(buf); err != nil {
+			log.Println("Rejecting webhook: ", err)
+			c.JSON(HTTPStatus(err), gin.H{"error": err.Error()})
+			return
+		}
 
+		// Pushes only change branches, no need to queue them
+		if eventKey == RepoPush {
+			var push RepoPushPayload
+			if err := json.Unmarshal(buf, &push); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
 			}
+			ctrl.bitbucketService.InvalidateBranches(push.Repository.Owner.UUID, push.Repository.Name)
+			c.JSON(http.StatusOK, nil)
+			return
+		}
 
-			// Fork for logic processing
-			if c.Request.Header.Get("X-Event-Key") == PrFufilled || PrForceRetrigger {
-				err = ctrl.bitbucketService.OnMerge(&PullRequestPayload)
-			} else {
-				err = ctrl.bitbucketService.TryMerge(&PullRequestPayload)
-			}
-			if err != nil {
-				log.Fatal(err)
+		// Retries and manual redeliveries keep the request UUID of the original delivery
+		deliveryID := deliveryID(c.Request)
+		if deliveryID != "" && !ctrl.deliveries.MarkIfNew(deliveryID) {
+			log.Println("Skipping duplicate delivery: ", deliveryID)
+			c.JSON(http.StatusOK, nil)
+			return
+		}
+
+		// Only acknowledge once the delivery is persisted, otherwise let Bitbucket redeliver it
+		_, err = ctrl.jobQueue.Enqueue(eventKey, buf)
+		if err != nil {
+			log.Println("Could not enqueue webhook: ", err)
+			if deliveryID != "" {
+				ctrl.deliveries.Forget(deliveryID)
 			}
-		}()
+			c.JSON(HTTPStatus(err), nil)
+			return
+		}
 
 		c.JSON(http.StatusOK, nil)
 	} else {
@@ -76,11 +131,209 @@ func (ctrl *BitbucketController) Webhook(c *gin.Context) {
 	}
 }
 
-func (ctrl *BitbucketController) validate(request *http.Request) bool {
-	keys, ok := request.URL.Query()["key"]
-	if !ok || len(keys[0]) < 1 {
+// Process runs a queued webhook delivery, errors are retried by the job queue
+func (ctrl *BitbucketController) Process(job *Job) error {
+
+	var PrForceRetrigger bool
+
+	if job.EventKey == RepoCommitStatusCreated || job.EventKey == RepoCommitStatusUpdated {
+		var status RepoCommitStatusCreatedPayload
+		if err := json.Unmarshal(job.Payload, &status); err != nil {
+			return fmt.Errorf("%w: %v", ErrBadPayload, err)
+		}
+		ctrl.bitbucketService.RememberRepository(status.Repository)
+		return ctrl.bitbucketService.OnCommitStatus(&status)
+	}
+
+	PullRequestPayload, err := parsePayload(job.Payload)
+	if err != nil {
+		return err
+	}
+
+	if job.EventKey == ReconcileEvent {
+		return ctrl.bitbucketService.Reconcile(&PullRequestPayload.Repository)
+	}
+	ctrl.bitbucketService.RememberRepository(PullRequestPayload.Repository)
+	ctrl.bitbucketService.TrackPullRequest(PullRequestPayload)
+
+	// Detect a force-retrigger
+	if job.EventKey == PrCommentTrigger {
+		log.Println("In Detect a force-retrigger. Comment=", PullRequestPayload.Comment.Content.Raw)
+
+		// Only counts if comment = "#AutoCascade or new Jira editor is `#AutoCascade`"
+		if strings.TrimSpace(PullRequestPayload.Comment.Content.Raw) == "#AutoCascade" || strings.TrimSpace(PullRequestPayload.Comment.Content.Raw) == "`#AutoCascade`" || strings.TrimSpace(PullRequestPayload.Comment.Content.Raw) == "\\#AutoCascade" {
+			log.Println("In Set PrForceRetrigger = true")
+			PrForceRetrigger = true
+		}
+
+	}
+
+	// Fork for logic processing
+	if job.EventKey == PrFufilled || PrForceRetrigger {
+		err = ctrl.bitbucketService.OnMerge(PullRequestPayload)
+	} else {
+		err = ctrl.bitbucketService.TryMerge(PullRequestPayload)
+	}
+	return err
+}
+
+// Plans lists the latest dry run plans, newest first
+func (ctrl *BitbucketController) Plans(c *gin.Context) {
+	c.JSON(http.StatusOK, ctrl.bitbucketService.RecentPlans())
+}
+
+// Blocked lists the cascade pull requests waiting on merge conflicts
+func (ctrl *BitbucketController) Blocked(c *gin.Context) {
+	c.JSON(http.StatusOK, ctrl.bitbucketService.BlockedCascades())
+}
+
+// Cascade returns the cascade /cascades/:id with its pull requests as a tree across all sites
+func (ctrl *BitbucketController) Cascade(c *gin.Context) {
+	tree := ctrl.bitbucketService.CascadeTree(c.Param("id"))
+	if tree == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown cascade"})
+		return
+	}
+	c.JSON(http.StatusOK, tree)
+}
+
+// Dashboard renders the status page, filtered by the repository, site and stage query parameters
+func (ctrl *BitbucketController) Dashboard(c *gin.Context) {
+	jobs, err := ctrl.jobQueue.Failures(maxDashboardFailures)
+	if err != nil {
+		log.Println("Dashboard -> could not list webhook failures: ", err)
+	}
+	dashboard := ctrl.bitbucketService.Dashboard(DashboardFilter{
+		Repository: c.Query("repository"),
+		Site:       c.Query("site"),
+		Stage:      c.Query("stage"),
+	}, WebhookFailures(jobs))
+
+	var page bytes.Buffer
+	if err := DashboardTemplate.Execute(&page, dashboard); err != nil {
+		log.Println("Dashboard -> err: ", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Data(http.StatusOK, "text/html; charset=utf-8", page.Bytes())
+}
+
+// Drift lists the outcome of the last drift check per repository
+func (ctrl *BitbucketController) Drift(c *gin.Context) {
+	c.JSON(http.StatusOK, ctrl.bitbucketService.DriftReports())
+}
+
+// Plan dry runs a merge into ?branch= of ?repository=workspace/slug, optionally from ?source= and
+// with the merged pull request's ?title=, regardless of the repository's dry_run setting. It reads
+// Bitbucket on the shared request budget, so it requires the admin token
+func (ctrl *BitbucketController) Plan(c *gin.Context) {
+	if !ctrl.authorized(c.Request) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization: Bearer {ADMIN_TOKEN} is required"})
+		return
+	}
+	fullName := c.Query("repository")
+	branch := c.Query("branch")
+	parts := strings.SplitN(fullName, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || branch == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "repository=workspace/slug and branch are required"})
+		return
+	}
+
+	var request PullRequestMergedPayload
+	request.Repository.FullName = fullName
+	request.Repository.Name = parts[1]
+	request.Repository.Owner.Username = parts[0]
+	request.Repository.Owner.UUID = parts[0]
+	request.PullRequest.Title = c.Query("title")
+	request.PullRequest.Source.Branch.Name = c.Query("source")
+	request.PullRequest.Destination.Branch.Name = branch
+
+	plan, err := ctrl.bitbucketService.PlanMerge(&request)
+	if err != nil {
+		c.JSON(HTTPStatus(err), plan)
+		return
+	}
+	c.JSON(http.StatusOK, plan)
+}
+
+// deliveryID identifies a webhook delivery across retries, empty when Bitbucket did not send the headers
+func deliveryID(request *http.Request) string {
+	requestUUID := request.Header.Get(RequestUUIDHeader)
+	if requestUUID == "" {
+		return ""
+	}
+	return request.Header.Get(HookUUIDHeader) + "/" + requestUUID
+}
+
+func parsePayload(buf []byte) (*PullRequestMergedPayload, error) {
+	var payload PullRequestMergedPayload
+	if err := json.Unmarshal(buf, &payload); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadPayload, err)
+	}
+	return &payload, nil
+}
+
+// validate accepts a request carrying a valid HMAC-SHA256 body signature for any of the webhook
+// secrets, or when unsigned and legacy mode is enabled, the shared key as a query parameter
+func (ctrl *BitbucketController) validate(request *http.Request, body []byte) bool {
+	signature := request.Header.Get(SignatureHeader)
+	if signature != "" {
+		if !ValidSignature(body, signature, ctrl.WebhookSecrets) {
+			log.Println("Invalid ", SignatureHeader)
+			return false
+		}
+		return true
+	}
+
+	if ctrl.BitbucketSharedKey == "" {
+		log.Println("Missing ", SignatureHeader)
+		return false
+	}
+
+	key := request.URL.Query().Get("key")
+	if key == "" {
 		log.Println("Url Param 'key' is missing")
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(ctrl.BitbucketSharedKey), []byte(key)) == 1
+}
+
+// RequireAdmin guards the status endpoints with the admin token when it is set, they stay open without it
+func (ctrl *BitbucketController) RequireAdmin(c *gin.Context) {
+	if ctrl.AdminToken != "" && !ctrl.authorized(c.Request) {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authorization: Bearer {ADMIN_TOKEN} is required"})
+	}
+}
+
+// authorized accepts a request carrying the admin token as a bearer token, none when it isn't set
+func (ctrl *BitbucketController) authorized(request *http.Request) bool {
+	if ctrl.AdminToken == "" {
+		log.Println("ADMIN_TOKEN is not set")
+		return false
+	}
+	token := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(ctrl.AdminToken), []byte(token)) == 1
+}
+
+// ValidSignature checks a "sha256=<hex>" signature of body against each secret
+func ValidSignature(body []byte, signature string, secrets []string) bool {
+	if !strings.HasPrefix(signature, signaturePrefix) {
+		return false
+	}
+	expected, err := hex.DecodeString(strings.TrimPrefix(signature, signaturePrefix))
+	if err != nil {
+		return false
+	}
+
+	for _, secret := range secrets {
+		if secret == "" {
+			continue
+		}
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		if hmac.Equal(mac.Sum(nil), expected) {
+			return true
+		}
 	}
-	key := keys[0]
-	return ctrl.BitbucketSharedKey == key
+	return false
 }
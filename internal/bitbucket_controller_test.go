@@ -0,0 +1,202 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func sign(body []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestValidSignature(t *testing.T) {
+	body := []byte(`{"pullrequest":{"id":1}}`)
+	// The new secret first, the previous one kept while Bitbucket is being switched over
+	secrets := []string{"current", "previous"}
+
+	tests := []struct {
+		name      string
+		signature string
+		secrets   []string
+		valid     bool
+	}{
+		{"current secret", sign(body, "current"), secrets, true},
+		{"previous secret while rotating", sign(body, "previous"), secrets, true},
+		{"previous secret after rotating", sign(body, "previous"), []string{"current"}, false},
+		{"wrong secret", sign(body, "wrong"), secrets, false},
+		{"other body", sign([]byte(`{}`), "current"), secrets, false},
+		{"missing signature", "", secrets, false},
+		{"empty signature", signaturePrefix, secrets, false},
+		{"missing prefix", sign(body, "current")[len(signaturePrefix):], secrets, false},
+		{"other algorithm", "sha1=" + sign(body, "current")[len(signaturePrefix):], secrets, false},
+		{"bad hex", signaturePrefix + "zz", secrets, false},
+		{"no secrets", sign(body, "current"), nil, false},
+		{"empty secret", sign(body, ""), []string{""}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if valid := ValidSignature(body, test.signature, test.secrets); valid != test.valid {
+				t.Errorf("ValidSignature(%q) = %v, want %v", test.signature, valid, test.valid)
+			}
+		})
+	}
+}
+
+func TestValidateWebhook(t *testing.T) {
+	body := []byte(`{"pullrequest":{"id":1}}`)
+
+	tests := []struct {
+		name      string
+		sharedKey string
+		signature string
+		query     string
+		valid     bool
+	}{
+		{"signed", "", sign(body, "current"), "", true},
+		{"signed with the previous secret", "", sign(body, "previous"), "", true},
+		{"wrong signature", "", sign(body, "wrong"), "", false},
+		{"unsigned", "", "", "", false},
+		{"key without legacy mode", "", "", "?key=legacy", false},
+		{"legacy key", "legacy", "", "?key=legacy", true},
+		{"wrong legacy key", "legacy", "", "?key=other", false},
+		{"missing legacy key", "legacy", "", "", false},
+		// A signature is always checked, the key can't make up for a bad one
+		{"wrong signature with legacy key", "legacy", sign(body, "wrong"), "?key=legacy", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctrl := NewBitbucketController(nil, nil, nil, []string{"current", "previous"}, test.sharedKey, "")
+			request := httptest.NewRequest("POST", "/"+test.query, nil)
+			if test.signature != "" {
+				request.Header.Set(SignatureHeader, test.signature)
+			}
+			if valid := ctrl.validate(request, body); valid != test.valid {
+				t.Errorf("validate() = %v, want %v", valid, test.valid)
+			}
+		})
+	}
+}
+
+func TestAuthorized(t *testing.T) {
+	tests := []struct {
+		name          string
+		adminToken    string
+		authorization string
+		valid         bool
+	}{
+		{"token", "admin", "Bearer admin", true},
+		{"wrong token", "admin", "Bearer other", false},
+		{"missing token", "admin", "", false},
+		{"not a bearer token", "admin", "Basic admin", false},
+		{"disabled", "", "Bearer ", false},
+		{"disabled without header", "", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctrl := NewBitbucketController(nil, nil, nil, []string{"current"}, "", test.adminToken)
+			request := httptest.NewRequest("GET", "/plan?repository=workspace/repo&branch=develop", nil)
+			if test.authorization != "" {
+				request.Header.Set("Authorization", test.authorization)
+			}
+			if valid := ctrl.authorized(request); valid != test.valid {
+				t.Errorf("authorized() = %v, want %v", valid, test.valid)
+			}
+		})
+	}
+}
+
+func TestRequireAdmin(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	service, _ := newTestService(t, nil)
+
+	tests := []struct {
+		name          string
+		adminToken    string
+		authorization string
+		status        int
+	}{
+		{"token", "admin", "Bearer admin", http.StatusOK},
+		{"wrong token", "admin", "Bearer other", http.StatusUnauthorized},
+		{"missing token", "admin", "", http.StatusUnauthorized},
+		{"open without a token", "", "", http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctrl := NewBitbucketController(service, nil, nil, []string{"current"}, "", test.adminToken)
+			router := gin.New()
+			router.Group("/", ctrl.RequireAdmin).GET("/blocked", ctrl.Blocked)
+
+			request := httptest.NewRequest("GET", "/blocked", nil)
+			if test.authorization != "" {
+				request.Header.Set("Authorization", test.authorization)
+			}
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, request)
+			if recorder.Code != test.status {
+				t.Errorf("GET /blocked = %d, want %d", recorder.Code, test.status)
+			}
+		})
+	}
+}
+
+// counterValue reads a series of a counter
+func counterValue(counter *CounterVec, labelValues ...string) float64 {
+	counter.mu.Lock()
+	defer counter.mu.Unlock()
+	return counter.values[seriesKey(labelValues)]
+}
+
+func TestWebhookCountsValidDeliveries(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	service, _ := newTestService(t, nil)
+	ctrl := NewBitbucketController(service, nil, nil, []string{"current"}, "", "")
+	body := []byte(`{"repository":{"full_name":"workspace/repo","name":"repo","owner":{"uuid":"workspace"}}}`)
+
+	deliver := func(eventKey string, signature string) int {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest("POST", "/", bytes.NewReader(body))
+		c.Request.Header.Set("X-Event-Key", eventKey)
+		c.Request.Header.Set(SignatureHeader, signature)
+		ctrl.Webhook(c)
+		return recorder.Code
+	}
+
+	pushes := counterValue(WebhookEvents, RepoPush)
+	if code := deliver(RepoPush, sign(body, "wrong")); code != http.StatusForbidden {
+		t.Fatalf("unsigned delivery = %d, want 403", code)
+	}
+	if counterValue(WebhookEvents, RepoPush) != pushes {
+		t.Error("rejected delivery counted")
+	}
+	if code := deliver(RepoPush, sign(body, "current")); code != http.StatusOK {
+		t.Fatalf("signed delivery = %d, want 200", code)
+	}
+	if counterValue(WebhookEvents, RepoPush) != pushes+1 {
+		t.Error("signed delivery not counted")
+	}
+}
+
+func TestEventLabel(t *testing.T) {
+	for eventKey, label := range map[string]string{
+		PrFufilled:              PrFufilled,
+		RepoPush:                RepoPush,
+		RepoCommitStatusUpdated: RepoCommitStatusUpdated,
+		"pullrequest:created":   "pullrequest:created",
+		"":                      "other",
+		"made:up-1234":          "other",
+	} {
+		if got := eventLabel(eventKey); got != label {
+			t.Errorf("eventLabel(%q) = %q, want %q", eventKey, got, label)
+		}
+	}
+}
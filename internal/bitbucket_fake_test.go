@@ -0,0 +1,565 @@
+package internal
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakeBitbucket is an in-memory BitbucketAPI simulating repositories, branches, commits, pull requests and
+// commit statuses, so the cascade logic can be exercised without a live Bitbucket
+type FakeBitbucket struct {
+	mu    sync.Mutex
+	repos map[string]*fakeRepository
+	user  Owner
+	// userDown fails CurrentUser, like GET /user answering with an error
+	userDown bool
+}
+
+type fakeRepository struct {
+	branches map[string]*BranchRef
+	prs      []*PullRequest
+	approved map[int64]bool
+	comments map[int64][]string
+	statuses map[string][]CommitStatus
+	commits  map[string]*Commit
+	// conflicts are the conflicting paths of a pull request
+	conflicts map[int64][]string
+	// changes are the paths changed by a commit
+	changes map[string][]string
+	files   map[string][]byte
+}
+
+var _ BitbucketAPI = (*FakeBitbucket)(nil)
+
+func NewFakeBitbucket() *FakeBitbucket {
+	return &FakeBitbucket{
+		repos: make(map[string]*fakeRepository),
+		user:  Owner{UUID: "{cascade-bot}", AccountId: "cascade-bot", DisplayName: "Cascade Bot"},
+	}
+}
+
+// AddBranch creates or moves a branch to the given commit
+func (fake *FakeBitbucket) AddBranch(repoOwner string, repoSlug string, name string, commitHash string) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	repo := fake.repo(repoOwner, repoSlug)
+	branch := &BranchRef{Name: name}
+	branch.Target.Hash = commitHash
+	branch.Target.Date = time.Now()
+	repo.branches[name] = branch
+	repo.addCommit(commitHash, "", nil)
+}
+
+// AddCommit commits on top of a branch, creating the branch when missing
+func (fake *FakeBitbucket) AddCommit(repoOwner string, repoSlug string, branchName string, commitHash string, message string) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	repo := fake.repo(repoOwner, repoSlug)
+	branch, ok := repo.branches[branchName]
+	if !ok {
+		branch = &BranchRef{Name: branchName}
+		repo.branches[branchName] = branch
+	}
+	var parents []string
+	if branch.Target.Hash != "" {
+		parents = append(parents, branch.Target.Hash)
+	}
+	repo.addCommit(commitHash, message, parents)
+	branch.Target.Hash = commitHash
+	branch.Target.Date = time.Now()
+}
+
+// SetCommitStatus adds or replaces (by key) a build status of a commit
+func (fake *FakeBitbucket) SetCommitStatus(repoOwner string, repoSlug string, commitHash string, status CommitStatus) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	repo := fake.repo(repoOwner, repoSlug)
+	statuses := repo.statuses[commitHash]
+	for i := range statuses {
+		if statuses[i].Key == status.Key {
+			statuses[i] = status
+			return
+		}
+	}
+	repo.statuses[commitHash] = append(statuses, status)
+}
+
+// SetMergeStrategies restricts the merge strategies allowed on a branch
+func (fake *FakeBitbucket) SetMergeStrategies(repoOwner string, repoSlug string, name string, strategies ...string) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	if branch, ok := fake.repo(repoOwner, repoSlug).branches[name]; ok {
+		branch.MergeStrategies = strategies
+		if len(strategies) > 0 {
+			branch.DefaultMergeStrategy = strategies[0]
+		}
+	}
+}
+
+// SetConflicts makes a pull request report the paths as merge conflicts and fail to merge, none clears them
+func (fake *FakeBitbucket) SetConflicts(repoOwner string, repoSlug string, pullRequestId int64, paths ...string) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	fake.repo(repoOwner, repoSlug).conflicts[pullRequestId] = paths
+}
+
+// SetCommitFiles records the paths a commit changes, for the diffstat of the pull requests carrying it
+func (fake *FakeBitbucket) SetCommitFiles(repoOwner string, repoSlug string, commitHash string, paths ...string) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	fake.repo(repoOwner, repoSlug).changes[commitHash] = paths
+}
+
+// SetFile stores the content of a file, the same on every branch
+func (fake *FakeBitbucket) SetFile(repoOwner string, repoSlug string, path string, content string) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	fake.repo(repoOwner, repoSlug).files[path] = []byte(content)
+}
+
+// SetCurrentUser changes the account returned by CurrentUser
+func (fake *FakeBitbucket) SetCurrentUser(user Owner) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	fake.user = user
+}
+
+// SetCurrentUserDown makes CurrentUser fail until called with false
+func (fake *FakeBitbucket) SetCurrentUserDown(down bool) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	fake.userDown = down
+}
+
+// PullRequests returns a copy of every pull request of the repository, in creation order
+func (fake *FakeBitbucket) PullRequests(repoOwner string, repoSlug string) []PullRequest {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	var prs []PullRequest
+	for _, pr := range fake.repo(repoOwner, repoSlug).prs {
+		prs = append(prs, *pr)
+	}
+	return prs
+}
+
+// Comments returns the comments posted on a pull request
+func (fake *FakeBitbucket) Comments(repoOwner string, repoSlug string, pullRequestId int64) []string {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	return append([]string(nil), fake.repo(repoOwner, repoSlug).comments[pullRequestId]...)
+}
+
+// Approved reports whether a pull request was approved
+func (fake *FakeBitbucket) Approved(repoOwner string, repoSlug string, pullRequestId int64) bool {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	return fake.repo(repoOwner, repoSlug).approved[pullRequestId]
+}
+
+func (fake *FakeBitbucket) ListBranches(repoOwner string, repoSlug string, nameFilter []string) ([]BranchRef, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	var branches []BranchRef
+	for _, branch := range fake.repo(repoOwner, repoSlug).branches {
+		if matchesNameFilter(branch.Name, nameFilter) {
+			branches = append(branches, *branch)
+		}
+	}
+	sort.Slice(branches, func(i, j int) bool {
+		return branches[i].Name < branches[j].Name
+	})
+	return branches, nil
+}
+
+func (fake *FakeBitbucket) ListPullRequests(repoOwner string, repoSlug string, filter PullRequestFilter) ([]PullRequest, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	var prs []PullRequest
+	for _, pr := range fake.repo(repoOwner, repoSlug).prs {
+		if filter.Matches(pr) {
+			prs = append(prs, *pr)
+		}
+	}
+	return prs, nil
+}
+
+func (fake *FakeBitbucket) GetPullRequest(repoOwner string, repoSlug string, pullRequestId int64) (*PullRequest, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	pr, err := fake.repo(repoOwner, repoSlug).pullRequest("GetPullRequest", pullRequestId)
+	if err != nil {
+		return nil, err
+	}
+	found := *pr
+	return &found, nil
+}
+
+func (fake *FakeBitbucket) CreatePullRequest(repoOwner string, repoSlug string, options PullRequestOptions) (*PullRequest, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	repo := fake.repo(repoOwner, repoSlug)
+	source, ok := repo.branches[options.SourceBranch]
+	if !ok {
+		return nil, fakeError("CreatePullRequest", http.StatusBadRequest, "source branch %s not found", options.SourceBranch)
+	}
+	destination, ok := repo.branches[options.DestinationBranch]
+	if !ok {
+		return nil, fakeError("CreatePullRequest", http.StatusBadRequest, "destination branch %s not found", options.DestinationBranch)
+	}
+	if source.Target.Hash == destination.Target.Hash {
+		return nil, fakeError("CreatePullRequest", http.StatusBadRequest, "There are no changes to be pulled")
+	}
+
+	pr := &PullRequest{
+		ID:                int64(len(repo.prs) + 1),
+		Title:             options.Title,
+		Description:       options.Description,
+		State:             "OPEN",
+		CloseSourceBranch: options.CloseSourceBranch,
+		CreatedOn:         time.Now(),
+		UpdatedOn:         time.Now(),
+	}
+	pr.Source.Branch.Name = source.Name
+	pr.Source.Commit.Hash = source.Target.Hash
+	pr.Destination.Branch.Name = destination.Name
+	pr.Destination.Commit.Hash = destination.Target.Hash
+	pr.Reviewers = fakeReviewers(options.Reviewers)
+	pr.Author = fake.user
+	repo.prs = append(repo.prs, pr)
+
+	created := *pr
+	return &created, nil
+}
+
+func (fake *FakeBitbucket) ApprovePullRequest(repoOwner string, repoSlug string, pullRequestId int64) error {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	repo := fake.repo(repoOwner, repoSlug)
+	if _, err := repo.pullRequest("ApprovePullRequest", pullRequestId); err != nil {
+		return err
+	}
+	repo.approved[pullRequestId] = true
+	return nil
+}
+
+// MergePullRequest moves the destination branch according to the strategy, rejecting strategies
+// the destination branch doesn't allow
+func (fake *FakeBitbucket) MergePullRequest(repoOwner string, repoSlug string, pullRequestId int64, options MergeOptions) error {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	repo := fake.repo(repoOwner, repoSlug)
+	pr, err := repo.pullRequest("MergePullRequest", pullRequestId)
+	if err != nil {
+		return err
+	}
+	if pr.State != "OPEN" {
+		return fakeError("MergePullRequest", http.StatusBadRequest, "pull request %d is %s", pullRequestId, pr.State)
+	}
+	if len(repo.conflicts[pullRequestId]) > 0 {
+		return fakeError("MergePullRequest", http.StatusBadRequest, "You can't merge until you resolve all merge conflicts")
+	}
+
+	destination := repo.branches[pr.Destination.Branch.Name]
+	if options.Strategy != "" && len(destination.MergeStrategies) > 0 && !containsString(destination.MergeStrategies, options.Strategy) {
+		return fakeError("MergePullRequest", http.StatusBadRequest, "merge strategy %s is not allowed on %s", options.Strategy, destination.Name)
+	}
+	message := options.Message
+	if message == "" {
+		message = "Merged in " + pr.Source.Branch.Name
+	}
+
+	sum := sha1.Sum([]byte(destination.Target.Hash + pr.Source.Commit.Hash))
+	mergeHash := hex.EncodeToString(sum[:])
+	switch options.Strategy {
+	case "fast_forward":
+		if !repo.reachable(pr.Source.Commit.Hash)[destination.Target.Hash] {
+			return fakeError("MergePullRequest", http.StatusBadRequest, "%s can't be fast-forwarded", destination.Name)
+		}
+		mergeHash = pr.Source.Commit.Hash
+	case "squash":
+		repo.addCommit(mergeHash, message, []string{destination.Target.Hash})
+	default:
+		repo.addCommit(mergeHash, message, []string{destination.Target.Hash, pr.Source.Commit.Hash})
+	}
+	destination.Target.Hash = mergeHash
+	destination.Target.Date = time.Now()
+
+	pr.State = "MERGED"
+	pr.MergeCommit.Hash = destination.Target.Hash
+	pr.UpdatedOn = time.Now()
+	return nil
+}
+
+func (fake *FakeBitbucket) PostComment(repoOwner string, repoSlug string, pullRequestId int64, content string) error {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	repo := fake.repo(repoOwner, repoSlug)
+	if _, err := repo.pullRequest("PostComment", pullRequestId); err != nil {
+		return err
+	}
+	repo.comments[pullRequestId] = append(repo.comments[pullRequestId], content)
+	return nil
+}
+
+func (fake *FakeBitbucket) GetCommitStatuses(repoOwner string, repoSlug string, commitHash string) ([]CommitStatus, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	return append([]CommitStatus(nil), fake.repo(repoOwner, repoSlug).statuses[commitHash]...), nil
+}
+
+func (fake *FakeBitbucket) ListCommits(repoOwner string, repoSlug string, include string, exclude string) ([]Commit, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	repo := fake.repo(repoOwner, repoSlug)
+	excluded := repo.reachable(repo.resolve(exclude))
+
+	var commits []Commit
+	for _, hash := range repo.ancestry(repo.resolve(include)) {
+		if !excluded[hash] {
+			commits = append(commits, *repo.commits[hash])
+		}
+	}
+	return commits, nil
+}
+
+func (fake *FakeBitbucket) GetDiffStat(repoOwner string, repoSlug string, pullRequestId int64) ([]DiffStat, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	repo := fake.repo(repoOwner, repoSlug)
+	pr, err := repo.pullRequest("GetDiffStat", pullRequestId)
+	if err != nil {
+		return nil, err
+	}
+	var diffStats []DiffStat
+	excluded := repo.reachable(pr.Destination.Commit.Hash)
+	for _, hash := range repo.ancestry(pr.Source.Commit.Hash) {
+		for _, path := range repo.changes[hash] {
+			if excluded[hash] || containsString(repo.conflicts[pullRequestId], path) {
+				continue
+			}
+			diffStat := DiffStat{Status: "modified"}
+			diffStat.New = &struct {
+				Path string `json:"path"`
+			}{path}
+			diffStats = append(diffStats, diffStat)
+		}
+	}
+	for _, path := range repo.conflicts[pullRequestId] {
+		diffStat := DiffStat{Status: "merge conflict"}
+		diffStat.New = &struct {
+			Path string `json:"path"`
+		}{path}
+		diffStats = append(diffStats, diffStat)
+	}
+	return diffStats, nil
+}
+
+func (fake *FakeBitbucket) UpdatePullRequest(repoOwner string, repoSlug string, pullRequestId int64, update PullRequestUpdate) error {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	pr, err := fake.repo(repoOwner, repoSlug).pullRequest("UpdatePullRequest", pullRequestId)
+	if err != nil {
+		return err
+	}
+	if update.Title != "" {
+		pr.Title = update.Title
+	}
+	if update.Reviewers != nil {
+		pr.Reviewers = fakeReviewers(update.Reviewers)
+	}
+	pr.UpdatedOn = time.Now()
+	return nil
+}
+
+func (fake *FakeBitbucket) DeclinePullRequest(repoOwner string, repoSlug string, pullRequestId int64) error {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	pr, err := fake.repo(repoOwner, repoSlug).pullRequest("DeclinePullRequest", pullRequestId)
+	if err != nil {
+		return err
+	}
+	if pr.State != "OPEN" {
+		return fakeError("DeclinePullRequest", http.StatusBadRequest, "pull request %d is %s", pullRequestId, pr.State)
+	}
+	pr.State = "DECLINED"
+	pr.UpdatedOn = time.Now()
+	return nil
+}
+
+func (fake *FakeBitbucket) CreateBranch(repoOwner string, repoSlug string, name string, commitHash string) error {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	repo := fake.repo(repoOwner, repoSlug)
+	if _, ok := repo.branches[name]; ok {
+		return fakeError("CreateBranch", http.StatusBadRequest, "branch %s already exists", name)
+	}
+	hash := repo.resolve(commitHash)
+	if _, ok := repo.commits[hash]; !ok {
+		return fakeError("CreateBranch", http.StatusBadRequest, "commit %s not found", commitHash)
+	}
+	branch := &BranchRef{Name: name}
+	branch.Target.Hash = hash
+	branch.Target.Date = time.Now()
+	repo.branches[name] = branch
+	return nil
+}
+
+func (fake *FakeBitbucket) CurrentUser() (*Owner, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	if fake.userDown {
+		return nil, fakeError("CurrentUser", http.StatusServiceUnavailable, "user lookup unavailable")
+	}
+	user := fake.user
+	return &user, nil
+}
+
+func (fake *FakeBitbucket) GetFileContent(repoOwner string, repoSlug string, ref string, path string) ([]byte, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	content, ok := fake.repo(repoOwner, repoSlug).files[path]
+	if !ok {
+		return nil, fakeError("GetFileContent", http.StatusNotFound, "file %s not found", path)
+	}
+	return append([]byte(nil), content...), nil
+}
+
+func fakeReviewers(reviewers []string) []Owner {
+	var owners []Owner
+	for _, reviewer := range reviewers {
+		if strings.HasPrefix(reviewer, "{") {
+			owners = append(owners, Owner{UUID: reviewer})
+		} else {
+			owners = append(owners, Owner{AccountId: reviewer})
+		}
+	}
+	return owners
+}
+
+// repo returns the repository, creating it on first use. Callers hold the lock.
+func (fake *FakeBitbucket) repo(repoOwner string, repoSlug string) *fakeRepository {
+	key := repoOwner + "/" + repoSlug
+	repo, ok := fake.repos[key]
+	if !ok {
+		repo = &fakeRepository{
+			branches:  make(map[string]*BranchRef),
+			approved:  make(map[int64]bool),
+			comments:  make(map[int64][]string),
+			statuses:  make(map[string][]CommitStatus),
+			commits:   make(map[string]*Commit),
+			conflicts: make(map[int64][]string),
+			changes:   make(map[string][]string),
+			files:     make(map[string][]byte),
+		}
+		fake.repos[key] = repo
+	}
+	return repo
+}
+
+func (repo *fakeRepository) addCommit(hash string, message string, parents []string) {
+	if _, ok := repo.commits[hash]; ok {
+		return
+	}
+	commit := &Commit{Hash: hash, Message: message, Date: time.Now()}
+	for _, parent := range parents {
+		commit.Parents = append(commit.Parents, struct {
+			Hash string `json:"hash"`
+		}{parent})
+	}
+	repo.commits[hash] = commit
+}
+
+// resolve turns a branch name into its head commit, anything else is taken as a hash
+func (repo *fakeRepository) resolve(ref string) string {
+	if branch, ok := repo.branches[ref]; ok {
+		return branch.Target.Hash
+	}
+	return ref
+}
+
+// ancestry lists hash and its ancestors, children before parents
+func (repo *fakeRepository) ancestry(hash string) []string {
+	var hashes []string
+	seen := make(map[string]bool)
+	queue := []string{hash}
+	for len(queue) > 0 {
+		hash, queue = queue[0], queue[1:]
+		commit, ok := repo.commits[hash]
+		if !ok || seen[hash] {
+			continue
+		}
+		seen[hash] = true
+		hashes = append(hashes, hash)
+		for _, parent := range commit.Parents {
+			queue = append(queue, parent.Hash)
+		}
+	}
+	return hashes
+}
+
+func (repo *fakeRepository) reachable(hash string) map[string]bool {
+	set := make(map[string]bool)
+	for _, ancestor := range repo.ancestry(hash) {
+		set[ancestor] = true
+	}
+	return set
+}
+
+func (repo *fakeRepository) pullRequest(operation string, pullRequestId int64) (*PullRequest, error) {
+	for _, pr := range repo.prs {
+		if pr.ID == pullRequestId {
+			return pr, nil
+		}
+	}
+	return nil, fakeError(operation, http.StatusNotFound, "pull request %d not found", pullRequestId)
+}
+
+func fakeError(operation string, statusCode int, format string, args ...interface{}) error {
+	return &UpstreamError{Operation: operation, StatusCode: statusCode, Err: fmt.Errorf(format, args...)}
+}
+
+// matchesNameFilter mirrors the server side `name ~ "..."` clauses of ListBranches
+func matchesNameFilter(name string, nameFilter []string) bool {
+	if len(nameFilter) == 0 {
+		return true
+	}
+	for _, part := range nameFilter {
+		if strings.Contains(strings.ToLower(name), strings.ToLower(part)) {
+			return true
+		}
+	}
+	return false
+}
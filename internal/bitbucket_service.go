@@ -3,28 +3,42 @@ package internal
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
 	"strings"
-
-	"github.com/ktrysmt/go-bitbucket"
+	"time"
 )
 
 type BitbucketService struct {
-	bitbucketClient       *bitbucket.Client
-	ReleaseBranchPrefix   string
-	DevelopmentBranchName string
+	bitbucketAPI BitbucketAPI
+	Registry     *CascadeRegistry
+	branchCache  *BranchCache
+	plans        *PlanLog
+	driftReports *driftReports
+	blocked      *BlockedStore
+	cascades     *CascadeStore
+	reconcile    *ReconcileStore
+	self         *currentUser
+	// plan is set on the dry run copy made by dryRun
+	plan *CascadePlan
 }
 
-func NewBitbucketService(bitbucketClient *bitbucket.Client,
-	releaseBranchPrefix string,
-	developmentBranchName string) *BitbucketService {
-
-	return &BitbucketService{bitbucketClient,
-		releaseBranchPrefix,
-		developmentBranchName}
+func NewBitbucketService(bitbucketAPI BitbucketAPI,
+	registry *CascadeRegistry,
+	branchCache *BranchCache,
+	blocked *BlockedStore,
+	cascades *CascadeStore,
+	reconcile *ReconcileStore) *BitbucketService {
+
+	return &BitbucketService{bitbucketAPI: bitbucketAPI,
+		Registry:     registry,
+		branchCache:  branchCache,
+		plans:        NewPlanLog(50),
+		driftReports: newDriftReports(),
+		blocked:      blocked,
+		cascades:     cascades,
+		reconcile:    reconcile,
+		self:         &currentUser{}}
 }
 
 /*** Utility Functions ***/
@@ -38,25 +52,54 @@ func (service *BitbucketService) PrettyPrint(i interface{}) string {
 
 // GetStringInBetween Returns empty string if no start string found
 func (service *BitbucketService) GetStringInBetween(value string, a string, b string) string {
-	// Get substring between two strings.
-	posFirst := strings.Index(value, a)
-	if posFirst == -1 {
-		return ""
+	return stringInBetween(value, a, b)
+}
+
+// IsNextTarget reports whether a merge into oldDest should cascade into target according to the pipeline
+func (service *BitbucketService) IsNextTarget(settings *RepositorySettings, oldDest string, target string) bool {
+	return service.isNextBranch(settings, settings.ParseBranch(oldDest), settings.ParseBranch(target))
+}
+
+func (service *BitbucketService) isNextBranch(settings *RepositorySettings, oldDest Branch, target Branch) bool {
+	if oldDest.Stage == nil || target.Stage == nil {
+		return false
+	}
+	if !settings.Pipeline.IsNext(oldDest.Stage, target.Stage) || !settings.Policy.CanTarget(target.Name) {
+		return false
 	}
-	posLast := strings.Index(value, b)
-	if posLast == -1 {
-		return ""
+	if oldDest.Stage.FanOut {
+		return true
 	}
-	posFirstAdjusted := posFirst + len(a)
-	if posFirstAdjusted >= posLast {
-		return ""
+	//check same site name, names the grammar can't read have no site to compare
+	if !oldDest.Matched || !target.Matched {
+		log.Println("SKIP site match (branch grammar) -> ", oldDest.Name, " -> ", target.Name)
+		return false
 	}
-	return value[posFirstAdjusted:posLast]
+	return oldDest.Site == target.Site
+}
+
+// NextTargets returns the branches a merge into branch cascades into
+func (service *BitbucketService) NextTargets(settings *RepositorySettings, branch Branch, targets []Branch) []string {
+	var next []string
+	if settings.ReleaseTrain && strings.HasPrefix(branch.Name, settings.ReleaseBranchPrefix) {
+		if target := service.ReleaseTrainNextTarget(settings, branch, targets); target != "" {
+			next = append(next, target)
+		}
+		return next
+	}
+	for _, target := range targets {
+		if service.isNextBranch(settings, branch, target) {
+			next = append(next, target.Name)
+		}
+	}
+	return next
 }
 
 /*** EXISTING PR -> AUTO APPROVE & MERGE ***/
 /* ======================================= */
 
+// TryMerge approves and merges the pull request of the event when it is an open #AutoCascade one,
+// other open pull requests are left to their own events and the Reconciler
 func (service *BitbucketService) TryMerge(dat *PullRequestMergedPayload) error {
 
 	log.Println("--------- START TryMerge ---------")
@@ -66,9 +109,29 @@ func (service *BitbucketService) TryMerge(dat *PullRequestMergedPayload) error {
 	log.Println("dat.Repository.Owner.UUID: ", dat.Repository.Owner.UUID)
 	log.Println("os.Getenv('BITBUCKET_USERNAME'): ", os.Getenv("BITBUCKET_USERNAME"))
 
-	//err := service.DoApproveAndMerge(dat.Repository.Owner.Username, dat.Repository.Name)
-	//err := service.DoApproveAndMerge(os.Getenv("BITBUCKET_USERNAME"), dat.Repository.Name)
-	err := service.DoApproveAndMerge(dat.Repository.Owner.UUID, dat.Repository.Name)
+	settings := service.Registry.For(dat.Repository.FullName)
+	if !settings.AutoMerge {
+		log.Println("SKIP Auto Merge (disabled for repository) -> ", dat.Repository.FullName)
+		return nil
+	}
+	if settings.DryRun && service.plan == nil {
+		_, err := service.runPlanned(dat.Repository.FullName, dat.PullRequest.Destination.Branch.Name, func(dry *BitbucketService) error {
+			return dry.TryMerge(dat)
+		})
+		return err
+	}
+
+	pr := &dat.PullRequest
+	//Only auto approve & merge when includes #AutoCascade
+	if !strings.Contains(pr.Title, "#AutoCascade") || pr.State != "OPEN" {
+		log.Println("SKIP Auto Merge (not an open #AutoCascade PR) -> ", pr.ID, pr.State)
+		return nil
+	}
+
+	log.Println("ID: ", pr.ID)
+	log.Println("Title: ", pr.Title)
+	log.Println("Destination: ", pr.Destination.Branch.Name)
+	err := service.ApprovePullRequest(settings, dat.Repository.Owner.UUID, dat.Repository.Name, pr)
 	if err != nil {
 		return err
 	}
@@ -77,43 +140,36 @@ func (service *BitbucketService) TryMerge(dat *PullRequestMergedPayload) error {
 	return nil
 }
 
-func (service *BitbucketService) DoApproveAndMerge(repoOwner string, repoName string) error {
+func (service *BitbucketService) DoApproveAndMerge(settings *RepositorySettings, repoOwner string, repoName string) error {
 	log.Println("--------- START DoApproveAndMerge ---------")
 
 	log.Println("Set options...")
 	log.Println("repoOwner: ", repoOwner)
 	log.Println("repoName: ", repoName)
 
-	options := bitbucket.PullRequestsOptions{
-		Owner:    repoOwner,
-		RepoSlug: repoName,
+	filter := PullRequestFilter{
 		//Only auto approve & merge when includes #AutoCascade
-		Query: "title ~ \"#AutoCascade\" AND state = \"OPEN\"",
-		//Approve all
-		//Query:    "state = \"OPEN\"",
-		States: []string{"OPEN"},
+		TitleContains: "#AutoCascade",
+		State:         "OPEN",
 	}
 
 	log.Println("B4 GET pullRequests...")
-	resp, err := service.bitbucketClient.Repositories.PullRequests.Gets(&options)
+	pullRequests, err := service.bitbucketAPI.ListPullRequests(repoOwner, repoName, filter)
 	if err != nil {
 		return err
 	}
 
 	log.Println("B4 looping through pullRequests...")
 
-	pullRequests := resp.(map[string]interface{})
+	for i := range pullRequests {
+		pr := &pullRequests[i]
 
-	for _, pr := range pullRequests["values"].([]interface{}) {
-
-		prUnwrapped := pr.(map[string]interface{})
-
-		log.Println("ID: ", prUnwrapped["id"])
-		log.Println("Title: ", prUnwrapped["title"])
-		log.Println("Destination: ", prUnwrapped["destination"].(map[string]interface{})["branch"].(map[string]interface{})["name"])
+		log.Println("ID: ", pr.ID)
+		log.Println("Title: ", pr.Title)
+		log.Println("Destination: ", pr.Destination.Branch.Name)
 		log.Println("Trying to Auto Approve...")
 
-		err = service.ApprovePullRequest(repoOwner, repoName, fmt.Sprintf("%v", prUnwrapped["id"]), fmt.Sprintf("%v", prUnwrapped["destination"].(map[string]interface{})["branch"].(map[string]interface{})["name"]))
+		err = service.ApprovePullRequest(settings, repoOwner, repoName, pr)
 		if err != nil {
 			return err
 		}
@@ -124,42 +180,41 @@ func (service *BitbucketService) DoApproveAndMerge(repoOwner string, repoName st
 	return nil
 }
 
-// HACK: There isn't an API method in the Bitbucket API Library to do pull request
-// approval. Hacking together one here.
-func (service *BitbucketService) ApprovePullRequest(repoOwner string, repoName string, pullRequestId string, destBranch string) error {
+func (service *BitbucketService) ApprovePullRequest(settings *RepositorySettings, repoOwner string, repoName string, pr *PullRequest) error {
 	log.Println("--------- START ApprovePullRequest ---------")
 
-	//Try approve (if not UAT)
-	if !strings.HasPrefix(destBranch, "uat") {
+	pullRequestId := pr.ID
+	destBranch := pr.Destination.Branch.Name
 
-		workspace := os.Getenv("BITBUCKET_WORKSPACE")
-		log.Println("workspace: ", workspace)
-
-		url := service.bitbucketClient.GetApiBaseURL() + "/repositories/" + workspace + "/" + repoName + "/pullrequests/" + pullRequestId + "/approve"
-		req, err := http.NewRequest("POST", url, nil)
+	//Try approve (if the policy allows)
+	if settings.Policy.CanApprove(destBranch) {
+		err := service.bitbucketAPI.ApprovePullRequest(repoOwner, repoName, pullRequestId)
 		if err != nil {
 			return err
 		}
-		username := os.Getenv("BITBUCKET_USERNAME")
-		password := os.Getenv("BITBUCKET_PASSWORD")
-		req.SetBasicAuth(username, password)
-		response, err := service.bitbucketClient.HttpClient.Do(req)
-		if err != nil {
-			return err
-		}
-		buf, err := ioutil.ReadAll(response.Body)
-		if err != nil {
-			return err
-		}
-		log.Println(service.PrettyPrint(buf))
 	} else {
 		log.Println("SKIP Auto Approve -> ", destBranch)
 	}
 
-	//Try merge (if not UAT or Release)
-	if !strings.HasPrefix(destBranch, "uat") && !strings.HasPrefix(destBranch, service.ReleaseBranchPrefix) {
+	//Try merge (if the policy allows)
+	if settings.Policy.CanMerge(destBranch) {
+		//Only merge on green builds, planned PRs have no commit yet so assume they pass
+		if pullRequestId > 0 || service.plan == nil {
+			passed, err := service.BuildsPassed(settings, repoOwner, repoName, pr.Source.Commit.Hash, destBranch)
+			if err != nil {
+				return err
+			}
+			if service.plan == nil {
+				service.cascades.SetWaiting(repositoryName(pr, repoOwner, repoName), pullRequestId, !passed)
+			}
+			if !passed {
+				log.Println("SKIP Auto Merge (waiting for builds) -> ", destBranch)
+				return nil
+			}
+		}
+
 		log.Println("Try to Auto Merge -> ", destBranch)
-		err := service.MergePullRequest(repoOwner, repoName, pullRequestId)
+		err := service.MergePullRequest(settings, repoOwner, repoName, pr)
 		if err != nil {
 			return err
 		}
@@ -171,20 +226,37 @@ func (service *BitbucketService) ApprovePullRequest(repoOwner string, repoName s
 	return nil
 }
 
-func (service *BitbucketService) MergePullRequest(repoOwner string, repoName string, pullRequestId string) error {
+func (service *BitbucketService) MergePullRequest(settings *RepositorySettings, repoOwner string, repoName string, pr *PullRequest) error {
 	log.Println("--------- START MergePullRequest ---------")
 
-	options := bitbucket.PullRequestsOptions{
-		Owner:    repoOwner,
-		RepoSlug: repoName,
-		ID:       pullRequestId,
+	options, err := service.MergeOptions(settings, repoOwner, repoName, pr)
+	if err != nil {
+		//Retrying won't change what the branch allows, tell the author instead
+		log.Println("SKIP Auto Merge -> ", err)
+		if err := service.blockMerge(settings, repoOwner, repoName, pr, err.Error()); err != nil {
+			log.Println("blockMerge -> err: ", err)
+		}
+		return nil
 	}
-	resp, err := service.bitbucketClient.Repositories.PullRequests.Merge(&options)
-	log.Println(service.PrettyPrint(resp))
+
+	err = service.bitbucketAPI.MergePullRequest(repoOwner, repoName, pr.ID, options)
 	if err != nil {
 		log.Println("error: ", err)
-		/* Don't return error (causes crash)
+		/* Don't return error (merge is retried on the next event)
 		return err */
+
+		//Tell the author when it's blocked by conflicts
+		if _, err := service.CheckConflicts(settings, repoOwner, repoName, pr); err != nil {
+			log.Println("CheckConflicts -> err: ", err)
+		}
+	} else {
+		if service.plan == nil {
+			service.blocked.Remove(repositoryName(pr, repoOwner, repoName), pr.ID)
+			//Merges of untracked pull requests are counted here, tracked ones when their state changes
+			if !service.updateHop(repositoryName(pr, repoOwner, repoName), pr.ID, "MERGED", time.Now()) {
+				CascadePullRequests.Inc("merged", settings.stageName(pr.Destination.Branch.Name))
+			}
+		}
 	}
 
 	log.Println("--------- End MergePullRequest ---------")
@@ -201,16 +273,49 @@ func (service *BitbucketService) OnMerge(request *PullRequestMergedPayload) erro
 	sourceBranchName := request.PullRequest.Source.Branch.Name
 	destBranchName := request.PullRequest.Destination.Branch.Name
 	authorId := request.PullRequest.Author.UUID
+	//Cascade PRs are authored by the bot, keep tracking the original change
+	origin, err := service.originOf(&request.PullRequest)
+	if err != nil {
+		return err
+	}
 
 	log.Println("sourceBranchName", sourceBranchName)
 	log.Println("destBranchName", destBranchName)
 	log.Println("authorId", authorId)
 
+	settings := service.Registry.For(request.Repository.FullName)
+	log.Println("Repository settings: ", request.Repository.FullName, " -> ", settings.DevelopmentBranchName, settings.ReleaseBranchPrefix)
+	if settings.DryRun && service.plan == nil {
+		_, err := service.PlanMerge(request)
+		return err
+	}
+
+	if origin.PullRequest == nil {
+		//Only needed for the descriptions
+		original, err := service.bitbucketAPI.GetPullRequest(request.Repository.Owner.UUID, request.Repository.Name, origin.PullRequestID)
+		if err != nil {
+			log.Println("GetPullRequest (origin) -> err: ", err)
+		}
+		origin.PullRequest = original
+	}
+	//Cascades started before IDs were recorded get the same ID
+	if origin.CascadeID == "" {
+		origin.CascadeID = CascadeID(request.Repository.FullName, origin.PullRequestID)
+	}
+	log.Println("Cascade: ", origin.CascadeID)
+	service.startCascade(request.Repository.FullName, origin)
+
 	origTitle := request.PullRequest.Title
 	log.Println("Orig origTitle", origTitle)
-	siteSpecific := (destBranchName != service.DevelopmentBranchName && !strings.HasPrefix(origTitle, "#AutoCascade "))
+	siteSpecific := (destBranchName != settings.DevelopmentBranchName && !strings.HasPrefix(origTitle, "#AutoCascade "))
 
 	origTitle = strings.ReplaceAll(origTitle, "#AutoCascade ", "")
+	if settings.ConflictMarker != "" {
+		origTitle = strings.TrimSpace(strings.ReplaceAll(origTitle, settings.ConflictMarker, ""))
+	}
+	if service.plan == nil {
+		service.blocked.Remove(repositoryName(&request.PullRequest, request.Repository.Owner.UUID, request.Repository.Name), request.PullRequest.ID)
+	}
 	log.Println("Replaced origTitle", origTitle)
 
 	// NB!!! UNCOMMENT if only want create on 1st merge!
@@ -232,26 +337,41 @@ func (service *BitbucketService) OnMerge(request *PullRequestMergedPayload) erro
 	log.Println("siteSpecific: ", siteSpecific)
 
 	//targets, err := service.GetBranches(repoName, repoOwner)
-	targets, err := service.GetBranches(repoName, request.Repository.Owner.UUID)
+	targets, err := service.GetBranches(settings, repoName, request.Repository.Owner.UUID)
 
 	if err != nil {
 		return err
 	}
-	log.Println("Checking for internal targets: ", targets)
+	log.Println("Checking for internal targets: ", len(targets))
+
+	//Release branches follow the release train
+	if settings.ReleaseTrain && strings.HasPrefix(destBranchName, settings.ReleaseBranchPrefix) {
+		log.Println("Release train commit!")
+
+		nextTarget := service.ReleaseTrainNextTarget(settings, settings.ParseBranch(destBranchName), targets)
+
+		if nextTarget != "" {
+			log.Println("Call Create PR (Release train) -> Next Target: ", nextTarget)
+			err = service.CreatePullRequest(settings, origTitle, destBranchName, nextTarget, repoName, request.Repository.Owner.UUID, origin)
+			if err != nil {
+				log.Println("err: ", err)
+				return err
+			}
+		}
 
-	//Cater for starting in dev branch of particular site
-	if siteSpecific {
+		//Cater for starting in dev branch of particular site
+	} else if siteSpecific {
 		log.Println("Site-specific commit!")
 
-		nextTarget := service.SiteSpecificNextTarget(destBranchName, targets)
+		nextTarget := service.SiteSpecificNextTarget(settings, settings.ParseBranch(destBranchName), targets)
 
 		if nextTarget != "" {
 			log.Println("Call Create PR (Site-specific) -> Next Target: ", string(nextTarget))
 			//err = service.CreatePullRequest(destBranchName, nextTarget, repoName, repoOwner, authorId)
-			err = service.CreatePullRequest(origTitle, destBranchName, nextTarget, repoName, request.Repository.Owner.UUID, authorId)
+			err = service.CreatePullRequest(settings, origTitle, destBranchName, nextTarget, repoName, request.Repository.Owner.UUID, origin)
 			if err != nil {
 				log.Println("err: ", err)
-				//return err
+				return err
 			}
 		} else {
 			log.Println("SKIP Create PR (Site-specific) -> Next Target: ", string(nextTarget))
@@ -261,11 +381,11 @@ func (service *BitbucketService) OnMerge(request *PullRequestMergedPayload) erro
 	} else {
 		log.Println("All-sites commit!")
 
-		err := service.AllSitesNextTarget(destBranchName, targets, origTitle, repoName, request.Repository.Owner.UUID, authorId)
+		err := service.AllSitesNextTarget(settings, settings.ParseBranch(destBranchName), targets, origTitle, repoName, request.Repository.Owner.UUID, origin)
 
 		if err != nil {
 			log.Println("err: ", err)
-			//return err
+			return err
 		}
 	}
 	//}
@@ -275,49 +395,18 @@ func (service *BitbucketService) OnMerge(request *PullRequestMergedPayload) erro
 }
 
 // Site-Specific merge path
-func (service *BitbucketService) SiteSpecificNextTarget(oldDest string, cascadeTargets *[]string) string {
-	targets := *cascadeTargets
-
+func (service *BitbucketService) SiteSpecificNextTarget(settings *RepositorySettings, oldDest Branch, targets []Branch) string {
 	log.Println("--------- START SiteSpecificNextTarget ---------")
 
 	//Loop to find next target based on destination of merged PR
 	for i, target := range targets {
 		log.Println("Target Loop: ", i)
-		log.Println("oldDest: ", target)
-		log.Println("target: ", target)
-
-		//Main to Dev
-		if oldDest == service.DevelopmentBranchName && strings.HasPrefix(target, "dev") {
-			//check same site name
-			if service.GetStringInBetween(oldDest, "/", "_") == service.GetStringInBetween(target, "/", "_") {
-				log.Println("Dev to QA: ", target)
-				return target
-			}
-		}
-		//Dev to QA
-		if strings.HasPrefix(oldDest, "dev") && strings.HasPrefix(target, "qa") {
-			//check same site name
-			if service.GetStringInBetween(oldDest, "/", "_") == service.GetStringInBetween(target, "/", "_") {
-				log.Println("Dev to QA: ", target)
-				return target
-			}
-		}
-		//QA to UAT
-		//Commented to allow Cherry-picking for UAT testing
-		if strings.HasPrefix(oldDest, "qa") && strings.HasPrefix(target, "uat") {
-			//check same site name
-			if service.GetStringInBetween(oldDest, "/", "_") == service.GetStringInBetween(target, "/", "_") {
-				log.Println("QA to UAT: ", target)
-				return target
-			}
-		}
-		//UAT to Release
-		if strings.HasPrefix(oldDest, "uat") && strings.HasPrefix(target, service.ReleaseBranchPrefix) {
-			//check same site name
-			if service.GetStringInBetween(oldDest, "/", "_") == service.GetStringInBetween(target, "/", "_") {
-				log.Println("QA to UAT: ", target)
-				return target
-			}
+		log.Println("oldDest: ", oldDest.Name)
+		log.Println("target: ", target.Name)
+
+		if service.isNextBranch(settings, oldDest, target) {
+			log.Println("Next Target: ", target.Name)
+			return target.Name
 		}
 	}
 
@@ -327,91 +416,37 @@ func (service *BitbucketService) SiteSpecificNextTarget(oldDest string, cascadeT
 }
 
 // Mine
-func (service *BitbucketService) AllSitesNextTarget(oldDest string, cascadeTargets *[]string, origTitle string, repoName string, repoOwner string, authorId string) error {
-	targets := *cascadeTargets
+func (service *BitbucketService) AllSitesNextTarget(settings *RepositorySettings, oldDest Branch, targets []Branch, origTitle string, repoName string, repoOwner string, origin CascadeOrigin) error {
+	var firstErr error
 
 	log.Println("--------- START AllSitesNextTarget ---------")
 
 	//Loop to find next target based on destination of merged PR
 	for i, target := range targets {
 		log.Println("Target Loop: ", i)
-		log.Println("oldDest: ", oldDest)
-		log.Println("target: ", target)
-		log.Println("oldDest Site: ", service.GetStringInBetween(oldDest, "/", "_"))
-		log.Println("target Site: ", service.GetStringInBetween(target, "/", "_"))
-
-		//Main to Dev
-		if oldDest == service.DevelopmentBranchName && strings.HasPrefix(target, "dev") {
-			log.Println("Dev to QA: Call Create PR (All-sites) -> Next Target: ", target)
-			err := service.CreatePullRequest(origTitle, oldDest, target, repoName, repoOwner, authorId)
-			if err != nil {
-				log.Println("err: ", err)
-				//return err
-			}
-		}
-		//Dev to QA
-		if strings.HasPrefix(oldDest, "dev") && strings.HasPrefix(target, "qa") &&
-			//check same site name
-			service.GetStringInBetween(oldDest, "/", "_") == service.GetStringInBetween(target, "/", "_") {
-			log.Println("Dev to QA: Call Create PR (All-sites) -> Next Target: ", target)
-			err := service.CreatePullRequest(origTitle, oldDest, target, repoName, repoOwner, authorId)
-			if err != nil {
-				log.Println("err: ", err)
-				//return err
-			}
-		}
-		//QA to UAT
-		//Commented to allow Cherry-picking for UAT testing
-		if strings.HasPrefix(oldDest, "qa") && strings.HasPrefix(target, "uat") &&
-			//check same site name
-			service.GetStringInBetween(oldDest, "/", "_") == service.GetStringInBetween(target, "/", "_") {
-			log.Println("QA to UAT: Call Create PR (All-sites) -> Next Target: ", target)
-			err := service.CreatePullRequest(origTitle, oldDest, target, repoName, repoOwner, authorId)
+		log.Println("oldDest: ", oldDest.Name)
+		log.Println("target: ", target.Name)
+		log.Println("oldDest Site: ", oldDest.Site)
+		log.Println("target Site: ", target.Site)
+
+		if service.isNextBranch(settings, oldDest, target) {
+			log.Println("Call Create PR (All-sites) -> Next Target: ", target.Name)
+			err := service.CreatePullRequest(settings, origTitle, oldDest.Name, target.Name, repoName, repoOwner, origin)
 			if err != nil {
 				log.Println("err: ", err)
-				//return err
-			}
-		}
-		//UAT to Release
-		if strings.HasPrefix(oldDest, "uat") && strings.HasPrefix(target, service.ReleaseBranchPrefix) &&
-			//check same site name
-			service.GetStringInBetween(oldDest, "/", "_") == service.GetStringInBetween(target, "/", "_") {
-			log.Println("UAT to Release: Call Create PR (All-sites) -> Next Target: ", target)
-			err := service.CreatePullRequest(origTitle, oldDest, target, repoName, repoOwner, authorId)
-			if err != nil {
-				log.Println("err: ", err)
-				//return err
+				//Keep going so one failing site doesn't block the others
+				if firstErr == nil {
+					firstErr = err
+				}
 			}
 		}
 	}
 
 	log.Println("--------- End AllSitesNextTarget ---------")
 	//Fallback on no desitination branch
-	return nil
+	return firstErr
 }
 
-/* ORIGINAL (with versioning included)
-func (service *BitbucketService) NextTarget(oldDest string, cascadeTargets *[]string) string {
-	targets := *cascadeTargets
-	//Change release/YYYY.M.P --> vYYYY.M.P
-	destination := strings.ReplaceAll(oldDest, service.ReleaseBranchPrefix, "v")
-
-	//Change release/YYYY.M.P --> vYYYY.M.P
-	for i, _ := range targets {
-		targets[i] = strings.ReplaceAll(targets[i], service.ReleaseBranchPrefix, "v")
-	}
-	sort.SliceStable(targets, func(i, j int) bool {
-		return semver.Compare(targets[i], targets[j]) < 0
-	})
-	for _, target := range targets {
-		if semver.Compare(destination, target) < 0 {
-			return strings.ReplaceAll(target, "v", service.ReleaseBranchPrefix)
-		}
-	}
-	return service.DevelopmentBranchName
-}
-*/
-
 /*
 //ORIGINAL
 func (service *BitbucketService) GetBranches(repoSlug string, repoOwner string) (*[]string, error) {
@@ -444,62 +479,54 @@ func (service *BitbucketService) GetBranches(repoSlug string, repoOwner string)
 }
 */
 
-// My hacked version (ListBranches no longer supported?)
-func (service *BitbucketService) GetBranches(repoSlug string, repoOwner string) (*[]string, error) {
+// GetBranches returns the branches the cascade may target, parsed into their stage and site
+func (service *BitbucketService) GetBranches(settings *RepositorySettings, repoSlug string, repoOwner string) ([]Branch, error) {
 
 	log.Println("--------- START GetBranches ---------")
 	log.Println("repoOwner: ", repoOwner)
 	log.Println("repoSlug: ", repoSlug)
 
-	username := os.Getenv("BITBUCKET_USERNAME")
-	password := os.Getenv("BITBUCKET_PASSWORD")
-	workspace := os.Getenv("BITBUCKET_WORKSPACE")
-	log.Println("workspace: ", workspace)
-
-	//This worked before switching to syncreon workspace
-	//url := service.bitbucketClient.GetApiBaseURL() + "/repositories/" + username + "/" + repoSlug + "/refs/branches?pagelen=100"
-
-	url := service.bitbucketClient.GetApiBaseURL() + "/repositories/" + workspace + "/" + repoSlug + "/refs/branches?pagelen=100"
-	log.Println(string(url))
-	req, err := http.NewRequest("GET", url, nil)
+	branches, err := service.listBranches(settings, repoSlug, repoOwner)
 	if err != nil {
 		return nil, err
 	}
-	req.SetBasicAuth(username, password)
-	response, err := service.bitbucketClient.HttpClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	body, err := ioutil.ReadAll(response.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	//Enable for debugging
-	//log.Println("B4 Targets -> Branches resp body: ", string(body))
-
-	var result BranchesPayload
-
-	if err := json.Unmarshal(body, &result); err != nil { // Parse []byte to go struct pointer
-		log.Println("Can not unmarshal JSON")
-		log.Fatal(err)
-	}
 
 	//Loop through the data
-	targets := make([]string, len(result.Values))
-	for i, branch := range result.Values {
-		// Leave Production branches alone!
-		if strings.HasPrefix(branch.Name, "prod/") {
-			log.Println("PRODUCTION SKIPPED -> branch.Name: ", branch.Name)
+	targets := make([]Branch, 0, len(branches))
+	for _, branch := range branches {
+		// Leave protected (e.g. Production) branches alone!
+		if !settings.Policy.CanTarget(branch.Name) {
+			log.Println("PROTECTED SKIPPED -> branch.Name: ", branch.Name)
 		} else {
 			log.Println("Targets -> branch.Name: ", branch.Name)
-			targets[i] = branch.Name
+			targets = append(targets, settings.parseBranchRef(branch))
 		}
 	}
 
 	log.Println("--------- End GetBranches ---------")
 
-	return &targets, nil
+	return targets, nil
+}
+
+// listBranches returns the stage branches, from the cache when fresh
+func (service *BitbucketService) listBranches(settings *RepositorySettings, repoSlug string, repoOwner string) ([]BranchRef, error) {
+	branches, cached := service.branchCache.Get(repoOwner, repoSlug)
+	if cached {
+		log.Println("Using cached branches: ", len(branches))
+		return branches, nil
+	}
+	branches, err := service.bitbucketAPI.ListBranches(repoOwner, repoSlug, settings.branchNameFilter())
+	if err != nil {
+		return nil, err
+	}
+	service.branchCache.Put(repoOwner, repoSlug, branches)
+	return branches, nil
+}
+
+// InvalidateBranches drops the cached branch listing after a push to the repository
+func (service *BitbucketService) InvalidateBranches(repoOwner string, repoSlug string) {
+	log.Println("Invalidate cached branches -> ", repoOwner, repoSlug)
+	service.branchCache.Invalidate(repoOwner, repoSlug)
 }
 
 func (service *BitbucketService) PullRequestExists(repoName string, repoOwner string, source string, destination string) (bool, error) {
@@ -510,29 +537,33 @@ func (service *BitbucketService) PullRequestExists(repoName string, repoOwner st
 	log.Println("repoOwner: ", repoOwner)
 	log.Println("repoName: ", repoName)
 
-	options := bitbucket.PullRequestsOptions{
-		Owner:    repoOwner,
-		RepoSlug: repoName,
-		Query:    "state = \"OPEN\" AND destination.branch.name = \"" + destination + "\" AND source.branch.name=\"" + source + "\"",
-		States:   []string{"OPEN"},
+	filter := PullRequestFilter{
+		State:             "OPEN",
+		DestinationBranch: destination,
 	}
 
 	log.Println("B4 GET pullRequests...")
 
-	resp, err := service.bitbucketClient.Repositories.PullRequests.Gets(&options)
+	pullRequests, err := service.bitbucketAPI.ListPullRequests(repoOwner, repoName, filter)
 	if err != nil {
 		log.Println(err)
-		return false, nil
+		return false, err
 	}
 
-	pullRequests := resp.(map[string]interface{})
-	log.Println("Pull Req exists? -> Resp length: ", fmt.Sprint(len(pullRequests["values"].([]interface{}))))
+	log.Println("Pull Req exists? -> Resp length: ", fmt.Sprint(len(pullRequests)))
+
+	//A cascade moved onto a conflict branch counts as well
+	conflictBranch := ConflictBranchName(source, destination, "")
+	exists := false
+	for _, pr := range pullRequests {
+		exists = exists || pr.Source.Branch.Name == source || strings.HasPrefix(pr.Source.Branch.Name, conflictBranch)
+	}
 
 	log.Println("--------- End PullRequestExists ---------")
-	return len(pullRequests["values"].([]interface{})) > 0, nil
+	return exists, nil
 }
 
-func (service *BitbucketService) CreatePullRequest(origTitle string, src string, dest string, repoName string, repoOwner string, reviewer string) error {
+func (service *BitbucketService) CreatePullRequest(settings *RepositorySettings, origTitle string, src string, dest string, repoName string, repoOwner string, origin CascadeOrigin) error {
 
 	log.Println("--------- START CreatePullRequest ---------")
 
@@ -542,7 +573,6 @@ func (service *BitbucketService) CreatePullRequest(origTitle string, src string,
 	log.Println("PullRequestExists -> err?: ", err)
 
 	if err != nil {
-		log.Fatal(err)
 		return err
 	}
 
@@ -550,6 +580,9 @@ func (service *BitbucketService) CreatePullRequest(origTitle string, src string,
 
 	if exists {
 		log.Println("Skipping creation. Pull Request Exists: ", src, " -> ", dest)
+		if service.plan == nil {
+			CascadePullRequests.Inc("skipped", settings.stageName(dest))
+		}
 		return nil
 	}
 
@@ -557,16 +590,24 @@ func (service *BitbucketService) CreatePullRequest(origTitle string, src string,
 	log.Println("repoOwner: ", repoOwner)
 	log.Println("repoName: ", repoName)
 
-	options := &bitbucket.PullRequestsOptions{
-		Owner:             repoOwner,
-		RepoSlug:          repoName,
+	hop := origin.Hop(src, dest)
+	//Reviewers are best effort, the cascade goes on without the bot filtered out
+	reviewers, err := service.CascadeReviewers(settings, dest, origin)
+	if err != nil {
+		log.Println("CascadeReviewers -> err: ", err)
+	}
+
+	options := PullRequestOptions{
 		SourceBranch:      src,
 		DestinationBranch: dest,
 		Title:             "#AutoCascade " + origTitle,
-		Description: "#AutoCascade " + src + " -> " + dest + ", this branch will automatically be merged on " +
-			"successful build result+approval",
+		Description:       service.Describe(settings, repoOwner, repoName, src, dest, hop),
+		Reviewers:         reviewers,
 		CloseSourceBranch: false,
 	}
+	if lines := hop.DescriptionLines(); lines != "" {
+		options.Description += "\n\n" + lines
+	}
 	//SourceBranch:      "release/appleufi_1.0",
 	//DestinationBranch: "feature/appleufi_1.0",
 
@@ -574,10 +615,23 @@ func (service *BitbucketService) CreatePullRequest(origTitle string, src string,
 
 	log.Println("B4 CREATE pullRequests...")
 
-	resp, err := service.bitbucketClient.Repositories.PullRequests.Create(options)
+	resp, err := service.bitbucketAPI.CreatePullRequest(repoOwner, repoName, options)
 	if err != nil {
 		log.Println(service.PrettyPrint(err))
 		//panic(err)
+	} else {
+		if service.plan == nil {
+			CascadePullRequests.Inc("created", settings.stageName(dest))
+		}
+		service.recordHop(hop, resp, 0)
+		//The PR exists, failing to add the code owners only costs reviewers
+		if ownersErr := service.AddCodeOwners(settings, repoOwner, repoName, resp, reviewers); ownersErr != nil {
+			log.Println("AddCodeOwners -> err: ", ownersErr)
+		}
+		//The PR exists, a failed check is retried when merging
+		if _, conflictErr := service.CheckConflicts(settings, repoOwner, repoName, resp); conflictErr != nil {
+			log.Println("CheckConflicts -> err: ", conflictErr)
+		}
 	}
 
 	log.Println(service.PrettyPrint(resp))
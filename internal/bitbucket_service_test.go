@@ -0,0 +1,264 @@
+package internal
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testOwner = "workspace"
+const testSlug = "repo"
+
+// newTestService returns a service on a fake repository with the develop, dev, qa and uat branches of
+// the acme and globex sites, develop one commit ahead of the others
+func newTestService(t *testing.T, file *CascadeFile) (*BitbucketService, *FakeBitbucket) {
+	t.Helper()
+	if file == nil {
+		file = &CascadeFile{}
+	}
+	registry, err := NewCascadeRegistry(file, RepositorySettings{
+		DevelopmentBranchName: "develop",
+		ReleaseBranchPrefix:   "release/",
+		AutoMerge:             true,
+		ConflictMarker:        "[CONFLICT]",
+		ConflictBranches:      true,
+		Reviewers:             ReviewerSettings{Author: true, Approvers: true, CodeOwnersPath: "CODEOWNERS"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	blocked, err := NewBlockedStore(filepath.Join(dir, "blocked.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cascades, err := NewCascadeStore(filepath.Join(dir, "cascades.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reconcile, err := NewReconcileStore(filepath.Join(dir, "reconcile.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake := NewFakeBitbucket()
+	for _, branch := range []string{"develop", "dev/acme", "dev/globex", "qa/acme", "qa/globex", "uat/acme", "prod/acme"} {
+		fake.AddBranch(testOwner, testSlug, branch, "base")
+	}
+	fake.AddCommit(testOwner, testSlug, "develop", "feature1", "Add the feature")
+
+	return NewBitbucketService(fake, registry, NewBranchCache(0), blocked, cascades, reconcile), fake
+}
+
+// testPayload is a webhook payload of the test repository
+func testPayload(pr PullRequest) *PullRequestMergedPayload {
+	payload := &PullRequestMergedPayload{PullRequest: pr}
+	payload.Repository.FullName = testOwner + "/" + testSlug
+	payload.Repository.Name = testSlug
+	payload.Repository.Owner.UUID = testOwner
+	return payload
+}
+
+// originalMerge is the payload of a feature pull request merged into develop
+func originalMerge() *PullRequestMergedPayload {
+	pr := PullRequest{ID: 100, Title: "Add the feature", State: "MERGED", Author: Owner{AccountId: "alice"}}
+	pr.Source.Branch.Name = "feature/x"
+	pr.Destination.Branch.Name = "develop"
+	pr.Destination.Repository.FullName = testOwner + "/" + testSlug
+	return testPayload(pr)
+}
+
+// openCascades returns the open cascade pull requests by destination branch
+func openCascades(fake *FakeBitbucket) map[string]PullRequest {
+	open := make(map[string]PullRequest)
+	for _, pr := range fake.PullRequests(testOwner, testSlug) {
+		if pr.State == "OPEN" {
+			open[pr.Destination.Branch.Name] = pr
+		}
+	}
+	return open
+}
+
+func TestOnMergeIntoDevelopOpensEverySite(t *testing.T) {
+	service, fake := newTestService(t, nil)
+
+	if err := service.OnMerge(originalMerge()); err != nil {
+		t.Fatal(err)
+	}
+
+	open := openCascades(fake)
+	if len(open) != 2 {
+		t.Fatalf("open pull requests = %v, want dev/acme and dev/globex", open)
+	}
+	for _, dest := range []string{"dev/acme", "dev/globex"} {
+		pr, ok := open[dest]
+		if !ok {
+			t.Fatalf("no pull request into %s", dest)
+		}
+		if pr.Source.Branch.Name != "develop" || !strings.HasPrefix(pr.Title, "#AutoCascade ") {
+			t.Errorf("pull request into %s = %q from %s", dest, pr.Title, pr.Source.Branch.Name)
+		}
+		origin, _ := service.originOf(&pr)
+		if origin.PullRequestID != 100 || origin.Author.AccountId != "alice" || origin.CascadeID != CascadeID("workspace/repo", 100) {
+			t.Errorf("origin of %s = %+v", dest, origin)
+		}
+	}
+
+	// A redelivered webhook doesn't open them again
+	if err := service.OnMerge(originalMerge()); err != nil {
+		t.Fatal(err)
+	}
+	if prs := fake.PullRequests(testOwner, testSlug); len(prs) != 2 {
+		t.Errorf("pull requests after redelivery = %d, want 2", len(prs))
+	}
+}
+
+func TestTryMergeWaitsForBuilds(t *testing.T) {
+	service, fake := newTestService(t, nil)
+	if err := service.OnMerge(originalMerge()); err != nil {
+		t.Fatal(err)
+	}
+	pr := openCascades(fake)["dev/acme"]
+
+	//CI hasn't registered a build yet
+	if err := service.TryMerge(testPayload(pr)); err != nil {
+		t.Fatal(err)
+	}
+	if _, open := openCascades(fake)["dev/acme"]; !open {
+		t.Fatal("merged before any build was reported")
+	}
+
+	fake.SetCommitStatus(testOwner, testSlug, "feature1", CommitStatus{Key: "ci", State: "INPROGRESS"})
+	if err := service.TryMerge(testPayload(pr)); err != nil {
+		t.Fatal(err)
+	}
+	if _, open := openCascades(fake)["dev/acme"]; !open {
+		t.Fatal("merged before the build passed")
+	}
+	if !fake.Approved(testOwner, testSlug, pr.ID) {
+		t.Error("not approved")
+	}
+
+	fake.SetCommitStatus(testOwner, testSlug, "feature1", CommitStatus{Key: "ci", State: "SUCCESSFUL"})
+	if err := service.TryMerge(testPayload(pr)); err != nil {
+		t.Fatal(err)
+	}
+	if _, open := openCascades(fake)["dev/acme"]; open {
+		t.Fatal("not merged once the build passed")
+	}
+	// The other site waits for its own event
+	if _, open := openCascades(fake)["dev/globex"]; !open {
+		t.Error("dev/globex merged by the dev/acme event")
+	}
+}
+
+func TestOnMergeCascadesThroughTheSite(t *testing.T) {
+	service, fake := newTestService(t, nil)
+	if err := service.OnMerge(originalMerge()); err != nil {
+		t.Fatal(err)
+	}
+
+	// develop -> dev/acme -> qa/acme -> uat/acme, each merge event opening the next pull request
+	for _, dest := range []string{"dev/acme", "qa/acme"} {
+		pr, ok := openCascades(fake)[dest]
+		if !ok {
+			t.Fatalf("no pull request into %s", dest)
+		}
+		fake.SetCommitStatus(testOwner, testSlug, pr.Source.Commit.Hash, CommitStatus{Key: "ci", State: "SUCCESSFUL"})
+		if err := service.TryMerge(testPayload(pr)); err != nil {
+			t.Fatal(err)
+		}
+		merged := fake.PullRequests(testOwner, testSlug)[pr.ID-1]
+		if merged.State != "MERGED" {
+			t.Fatalf("pull request into %s is %s", dest, merged.State)
+		}
+		if err := service.OnMerge(testPayload(merged)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	open := openCascades(fake)
+	uat, ok := open["uat/acme"]
+	if !ok {
+		t.Fatalf("open pull requests = %v, want one into uat/acme", open)
+	}
+	if _, ok := open["qa/globex"]; ok {
+		t.Error("acme cascaded into qa/globex")
+	}
+	if origin, _ := service.originOf(&uat); origin.PullRequestID != 100 || strings.Join(origin.Path, " -> ") != "feature/x -> develop -> dev/acme -> qa/acme -> uat/acme" {
+		t.Errorf("origin of the uat pull request = %+v", origin)
+	}
+
+	// uat is approved and merged by hand
+	if err := service.TryMerge(testPayload(uat)); err != nil {
+		t.Fatal(err)
+	}
+	if fake.Approved(testOwner, testSlug, uat.ID) {
+		t.Error("uat pull request approved")
+	}
+	if _, open := openCascades(fake)["uat/acme"]; !open {
+		t.Error("uat pull request merged")
+	}
+
+	tree := service.CascadeTree(CascadeID("workspace/repo", 100))
+	if tree == nil || len(tree.Hops) != 4 {
+		t.Fatalf("cascade = %+v, want the 4 pull requests", tree)
+	}
+}
+
+func TestDryRunChangesNothing(t *testing.T) {
+	dryRun := true
+	service, fake := newTestService(t, &CascadeFile{RepositoryConfig: RepositoryConfig{DryRun: &dryRun}})
+
+	if err := service.OnMerge(originalMerge()); err != nil {
+		t.Fatal(err)
+	}
+	if prs := fake.PullRequests(testOwner, testSlug); len(prs) != 0 {
+		t.Fatalf("dry run opened %d pull requests", len(prs))
+	}
+
+	plans := service.RecentPlans()
+	if len(plans) != 1 {
+		t.Fatalf("plans = %d, want 1", len(plans))
+	}
+	created := make(map[string]bool)
+	for _, action := range plans[0].Actions {
+		if action.Action == "create" {
+			created[action.Destination] = true
+		}
+	}
+	if !created["dev/acme"] || !created["dev/globex"] {
+		t.Errorf("planned pull requests into %v, want dev/acme and dev/globex", created)
+	}
+}
+
+func TestDryRunKeepsBlockedCascades(t *testing.T) {
+	dryRun := true
+	service, _ := newTestService(t, &CascadeFile{RepositoryConfig: RepositoryConfig{DryRun: &dryRun}})
+	service.blocked.Put(&BlockedCascade{Repository: "workspace/repo", PullRequestID: 100, Source: "feature/x", Destination: "develop"})
+
+	// Planning the merge of a blocked pull request leaves it blocked
+	if err := service.OnMerge(originalMerge()); err != nil {
+		t.Fatal(err)
+	}
+	if service.blocked.Get("workspace/repo", 100) == nil {
+		t.Error("dry run removed the blocked cascade")
+	}
+}
+
+func TestOnMergeWithoutTheCurrentUser(t *testing.T) {
+	service, fake := newTestService(t, nil)
+	fake.SetCurrentUserDown(true)
+
+	// Reviewers are best effort, the cascade doesn't wait for GET /user
+	if err := service.OnMerge(originalMerge()); err != nil {
+		t.Fatal(err)
+	}
+	open := openCascades(fake)
+	if len(open) != 2 {
+		t.Fatalf("open pull requests = %v, want dev/acme and dev/globex", open)
+	}
+	if reviewers := open["dev/acme"].Reviewers; len(reviewers) != 1 || reviewers[0].AccountId != "alice" {
+		t.Errorf("reviewers = %+v, want alice", reviewers)
+	}
+}
@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Branch is a branch of the repository with its name parsed once by ParseBranch
+type Branch struct {
+	Name string    `json:"name"`
+	Hash string    `json:"hash"`
+	Date time.Time `json:"date"`
+	// Stage is the pipeline stage of the branch, nil when no stage matches
+	Stage *CascadeStage `json:"-"`
+	// Site is the site the branch belongs to, e.g. "acme" for "dev/acme_1.0", empty when it has none
+	Site    string `json:"site"`
+	Version string `json:"version"`
+	// Matched is false for names the branch grammar can't read, they have no site
+	Matched bool `json:"matched"`
+}
+
+// DefaultBranchGrammar reads "<stage>/<site>_<version>" names, the site and the version being
+// optional: "develop", "qa/acme", "dev/acme_1.0", "dev/acme_hotfix" and "release/2020.12.0" all
+// match. Whatever follows the first "_" is the version, a name without a site is all version.
+const DefaultBranchGrammar = `^(?P<stage>[^/_]+)(?:/(?P<site>[A-Za-z][^/_]*)?_?(?P<version>[^/]*))?$`
+
+// BranchGrammar splits branch names into stage, site and version with the named groups of a
+// regular expression. Only the site group is required.
+type BranchGrammar struct {
+	expr *regexp.Regexp
+}
+
+func NewBranchGrammar(expr string) (*BranchGrammar, error) {
+	compiled, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	if compiled.SubexpIndex("site") < 0 {
+		return nil, fmt.Errorf("%q has no (?P<site>...) group", expr)
+	}
+	return &BranchGrammar{expr: compiled}, nil
+}
+
+func (grammar *BranchGrammar) String() string {
+	return grammar.expr.String()
+}
+
+// Parse returns the stage, site and version groups of name, ok is false when it doesn't match
+func (grammar *BranchGrammar) Parse(name string) (stage string, site string, version string, ok bool) {
+	match := grammar.expr.FindStringSubmatch(name)
+	if match == nil {
+		return "", "", "", false
+	}
+	group := func(name string) string {
+		if i := grammar.expr.SubexpIndex(name); i >= 0 {
+			return match[i]
+		}
+		return ""
+	}
+	return group("stage"), group("site"), group("version"), true
+}
+
+// ParseBranch parses a branch name into its stage, site and version. The stage is the first one whose
+// pattern matches, or for names no pattern matches, the one named by the stage group of the grammar.
+func (settings *RepositorySettings) ParseBranch(name string) Branch {
+	branch := Branch{Name: name, Stage: settings.Pipeline.StageFor(name)}
+
+	var stageName string
+	stageName, branch.Site, branch.Version, branch.Matched = settings.Grammar.Parse(name)
+	if !branch.Matched {
+		log.Println("Branch doesn't match the branch grammar (no site) -> ", name, settings.Grammar)
+	}
+	if branch.Stage == nil && stageName != "" {
+		branch.Stage = settings.Pipeline.StageNamed(stageName)
+	}
+	return branch
+}
+
+// stageName returns the name of the stage of a branch, "none" when no stage matches
+func (settings *RepositorySettings) stageName(name string) string {
+	if stage := settings.ParseBranch(name).Stage; stage != nil {
+		return stage.Name
+	}
+	return "none"
+}
+
+// parseBranchRef parses a listed branch, keeping its head commit
+func (settings *RepositorySettings) parseBranchRef(ref BranchRef) Branch {
+	branch := settings.ParseBranch(ref.Name)
+	branch.Hash = ref.Target.Hash
+	branch.Date = ref.Target.Date
+	return branch
+}
+
+// stringInBetween returns the text between the first a and the first b, or empty string when
+// either is missing or b comes first
+func stringInBetween(value string, a string, b string) string {
+	// Get substring between two strings.
+	posFirst := strings.Index(value, a)
+	if posFirst == -1 {
+		return ""
+	}
+	posLast := strings.Index(value, b)
+	if posLast == -1 {
+		return ""
+	}
+	posFirstAdjusted := posFirst + len(a)
+	if posFirstAdjusted >= posLast {
+		return ""
+	}
+	return value[posFirstAdjusted:posLast]
+}
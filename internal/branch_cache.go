@@ -0,0 +1,57 @@
+package internal
+
+import (
+	"sync"
+	"time"
+)
+
+// BranchCache keeps the branch listing of each repository so large repositories don't pay for
+// the full listing on every merge. Entries are dropped on repo:push and expire after ttl in
+// case push events aren't delivered.
+type BranchCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]branchCacheEntry
+}
+
+type branchCacheEntry struct {
+	branches []BranchRef
+	storedAt time.Time
+}
+
+func NewBranchCache(ttl time.Duration) *BranchCache {
+	return &BranchCache{
+		ttl:     ttl,
+		entries: make(map[string]branchCacheEntry),
+	}
+}
+
+func (cache *BranchCache) Get(repoOwner string, repoSlug string) ([]BranchRef, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	entry, ok := cache.entries[branchCacheKey(repoOwner, repoSlug)]
+	if !ok || time.Since(entry.storedAt) >= cache.ttl {
+		return nil, false
+	}
+	return entry.branches, true
+}
+
+func (cache *BranchCache) Put(repoOwner string, repoSlug string, branches []BranchRef) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	cache.entries[branchCacheKey(repoOwner, repoSlug)] = branchCacheEntry{branches, time.Now()}
+}
+
+func (cache *BranchCache) Invalidate(repoOwner string, repoSlug string) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	delete(cache.entries, branchCacheKey(repoOwner, repoSlug))
+}
+
+func branchCacheKey(repoOwner string, repoSlug string) string {
+	return repoOwner + "/" + repoSlug
+}
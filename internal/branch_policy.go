@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// PolicyConfig is the deny rules of a repository as written in the config file. Rules are globs
+// ("*" matches any characters, including "/") or regular expressions when wrapped in slashes, e.g.
+// "/^hotfix-[0-9]+$/". A missing list inherits, an empty list clears the inherited rules.
+type PolicyConfig struct {
+	// NeverTarget branches are never cascaded into
+	NeverTarget []string `json:"never_target" yaml:"never_target"`
+	// NeverApprove branches never get cascade pull requests approved
+	NeverApprove []string `json:"never_approve" yaml:"never_approve"`
+	// NeverMerge branches never get cascade pull requests merged
+	NeverMerge []string `json:"never_merge" yaml:"never_merge"`
+}
+
+// DefaultPolicyConfig mirrors the historical rules: production branches are left alone, UAT is
+// approved and merged by hand and releases are merged by hand
+func DefaultPolicyConfig(releaseBranchPrefix string) PolicyConfig {
+	return PolicyConfig{
+		NeverTarget:  []string{"prod/*"},
+		NeverApprove: []string{"uat*"},
+		NeverMerge:   []string{"uat*", releaseBranchPrefix + "*"},
+	}
+}
+
+// overlay returns the config with the lists config sets replacing the inherited ones
+func (inherited PolicyConfig) overlay(config *PolicyConfig) PolicyConfig {
+	if config == nil {
+		return inherited
+	}
+	if config.NeverTarget != nil {
+		inherited.NeverTarget = config.NeverTarget
+	}
+	if config.NeverApprove != nil {
+		inherited.NeverApprove = config.NeverApprove
+	}
+	if config.NeverMerge != nil {
+		inherited.NeverMerge = config.NeverMerge
+	}
+	return inherited
+}
+
+// BranchPolicy decides which branches the cascade may target, approve and merge. It is the only
+// place those rules live.
+type BranchPolicy struct {
+	config       PolicyConfig
+	neverTarget  []*regexp.Regexp
+	neverApprove []*regexp.Regexp
+	neverMerge   []*regexp.Regexp
+}
+
+func NewBranchPolicy(config PolicyConfig) (*BranchPolicy, error) {
+	policy := &BranchPolicy{config: config}
+	var err error
+	if policy.neverTarget, err = compileRules(config.NeverTarget); err != nil {
+		return nil, fmt.Errorf("never_target: %v", err)
+	}
+	if policy.neverApprove, err = compileRules(config.NeverApprove); err != nil {
+		return nil, fmt.Errorf("never_approve: %v", err)
+	}
+	if policy.neverMerge, err = compileRules(config.NeverMerge); err != nil {
+		return nil, fmt.Errorf("never_merge: %v", err)
+	}
+	return policy, nil
+}
+
+func (policy *BranchPolicy) CanTarget(branchName string) bool {
+	return !matchesAny(policy.neverTarget, branchName)
+}
+
+func (policy *BranchPolicy) CanApprove(branchName string) bool {
+	return !matchesAny(policy.neverApprove, branchName)
+}
+
+func (policy *BranchPolicy) CanMerge(branchName string) bool {
+	return !matchesAny(policy.neverMerge, branchName)
+}
+
+func compileRules(rules []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(rules))
+	for _, rule := range rules {
+		var matcher *regexp.Regexp
+		var err error
+		if len(rule) > 1 && strings.HasPrefix(rule, "/") && strings.HasSuffix(rule, "/") {
+			matcher, err = regexp.Compile(rule[1 : len(rule)-1])
+		} else {
+			matcher, err = compileBranchPattern(rule)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %v", rule, err)
+		}
+		compiled = append(compiled, matcher)
+	}
+	return compiled, nil
+}
+
+func matchesAny(matchers []*regexp.Regexp, branchName string) bool {
+	for _, matcher := range matchers {
+		if matcher.MatchString(branchName) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBranchPolicy(t *testing.T) {
+	defaults := DefaultPolicyConfig("release/")
+
+	tests := []struct {
+		name    string
+		config  PolicyConfig
+		branch  string
+		target  bool
+		approve bool
+		merge   bool
+	}{
+		{name: "stage branch", config: defaults, branch: "qa/acme", target: true, approve: true, merge: true},
+		{name: "production", config: defaults, branch: "prod/acme", approve: true, merge: true},
+		{name: "uat", config: defaults, branch: "uat/acme", target: true},
+		{name: "uat without a site", config: defaults, branch: "uat", target: true},
+		{name: "release", config: defaults, branch: "release/1.0", target: true, approve: true},
+		{name: "glob spans slashes", config: PolicyConfig{NeverTarget: []string{"hotfix*"}}, branch: "hotfix/acme/1", approve: true, merge: true},
+		{name: "glob is anchored", config: PolicyConfig{NeverTarget: []string{"prod/*"}}, branch: "preprod/acme", target: true, approve: true, merge: true},
+		{name: "regular expression", config: PolicyConfig{NeverMerge: []string{"/^hotfix-[0-9]+$/"}}, branch: "hotfix-12", target: true, approve: true},
+		{name: "regular expression not matching", config: PolicyConfig{NeverMerge: []string{"/^hotfix-[0-9]+$/"}}, branch: "hotfix-12a", target: true, approve: true, merge: true},
+		{name: "unanchored regular expression", config: PolicyConfig{NeverApprove: []string{"/acme/"}}, branch: "qa/acme-eu", target: true, merge: true},
+		{name: "no rules", branch: "prod/acme", target: true, approve: true, merge: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			policy, err := NewBranchPolicy(test.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := policy.CanTarget(test.branch); got != test.target {
+				t.Errorf("CanTarget(%q) = %v, want %v", test.branch, got, test.target)
+			}
+			if got := policy.CanApprove(test.branch); got != test.approve {
+				t.Errorf("CanApprove(%q) = %v, want %v", test.branch, got, test.approve)
+			}
+			if got := policy.CanMerge(test.branch); got != test.merge {
+				t.Errorf("CanMerge(%q) = %v, want %v", test.branch, got, test.merge)
+			}
+		})
+	}
+}
+
+func TestPolicyConfigOverlay(t *testing.T) {
+	inherited := DefaultPolicyConfig("release/")
+
+	// A missing list inherits, an empty one clears
+	got := inherited.overlay(&PolicyConfig{NeverTarget: []string{"prod/*", "live/*"}, NeverMerge: []string{}})
+	if strings.Join(got.NeverTarget, ",") != "prod/*,live/*" {
+		t.Errorf("NeverTarget = %v", got.NeverTarget)
+	}
+	if strings.Join(got.NeverApprove, ",") != "uat*" {
+		t.Errorf("NeverApprove = %v, want the inherited rules", got.NeverApprove)
+	}
+	if len(got.NeverMerge) != 0 {
+		t.Errorf("NeverMerge = %v, want none", got.NeverMerge)
+	}
+	if got := inherited.overlay(nil); strings.Join(got.NeverMerge, ",") != "uat*,release/*" {
+		t.Errorf("overlay(nil).NeverMerge = %v", got.NeverMerge)
+	}
+}
+
+func TestNewBranchPolicyRejectsInvalidRules(t *testing.T) {
+	_, err := NewBranchPolicy(PolicyConfig{NeverApprove: []string{"uat*", "/[/"}})
+	if err == nil || !strings.HasPrefix(err.Error(), `never_approve: rule "/[/"`) {
+		t.Errorf("NewBranchPolicy() = %v, want the invalid never_approve rule", err)
+	}
+}
@@ -0,0 +1,40 @@
+package internal
+
+import "testing"
+
+func TestParseBranch(t *testing.T) {
+	settings := testSettings(t)
+
+	tests := []struct {
+		name    string
+		stage   string
+		site    string
+		version string
+	}{
+		{"develop", "develop", "", ""},
+		{"qa/acme", "qa", "acme", ""},
+		{"dev/acme_1.0", "dev", "acme", "1.0"},
+		{"dev/acme_v1.0", "dev", "acme", "v1.0"},
+		{"dev/acme_hotfix", "dev", "acme", "hotfix"},
+		{"release/acme_1.0", "release", "acme", "1.0"},
+		{"release/2020.12.0", "release", "", "2020.12.0"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			branch := settings.ParseBranch(test.name)
+			if !branch.Matched {
+				t.Fatalf("ParseBranch(%q) didn't match", test.name)
+			}
+			if branch.Stage == nil || branch.Stage.Name != test.stage {
+				t.Errorf("stage = %v, want %q", branch.Stage, test.stage)
+			}
+			if branch.Site != test.site || branch.Version != test.version {
+				t.Errorf("site, version = %q, %q, want %q, %q", branch.Site, branch.Version, test.site, test.version)
+			}
+		})
+	}
+
+	if branch := settings.ParseBranch("feature/x/y"); branch.Matched {
+		t.Errorf("ParseBranch(feature/x/y) matched with site %q", branch.Site)
+	}
+}
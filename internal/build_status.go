@@ -0,0 +1,117 @@
+package internal
+
+import (
+	"log"
+	"strings"
+)
+
+const RepoCommitStatusCreated = "repo:commit_status_created"
+const RepoCommitStatusUpdated = "repo:commit_status_updated"
+
+// CommitHash returns the commit the status was reported on, falling back to the commit link for
+// payloads without commit.hash
+func (payload *RepoCommitStatusCreatedPayload) CommitHash() string {
+	if payload.CommitStatus.Commit.Hash != "" {
+		return payload.CommitStatus.Commit.Hash
+	}
+	href := payload.CommitStatus.Links.Commit.Href
+	return href[strings.LastIndex(href, "/")+1:]
+}
+
+// sameCommit compares commit hashes that may be abbreviated, pull request payloads carry 12 characters
+func sameCommit(a string, b string) bool {
+	if a == "" || b == "" {
+		return false
+	}
+	return strings.HasPrefix(a, b) || strings.HasPrefix(b, a)
+}
+
+// BuildsPassed reports whether commitHash has a SUCCESSFUL status for every build required by the
+// stage of destBranch, or when the stage requires none, whether at least one build was reported and
+// every reported build succeeded. A commit without statuses hasn't passed, CI may not have started yet
+func (service *BitbucketService) BuildsPassed(settings *RepositorySettings, repoOwner string, repoName string, commitHash string, destBranch string) (bool, error) {
+	statuses, err := service.bitbucketAPI.GetCommitStatuses(repoOwner, repoName, commitHash)
+	if err != nil {
+		return false, err
+	}
+
+	states := make(map[string]string, len(statuses))
+	for _, status := range statuses {
+		states[status.Key] = status.State
+	}
+
+	var required []string
+	if stage := settings.ParseBranch(destBranch).Stage; stage != nil {
+		required = stage.RequiredBuilds
+	}
+	if len(required) == 0 {
+		for key := range states {
+			required = append(required, key)
+		}
+		if len(required) == 0 {
+			log.Println("No build reported -> ", commitHash)
+			return false, nil
+		}
+	}
+
+	for _, key := range required {
+		if states[key] != "SUCCESSFUL" {
+			log.Println("Build not passed -> ", commitHash, key, states[key])
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+/*** BUILD STATUS -> MERGE GREEN PRs ***/
+/* =================================== */
+
+// OnCommitStatus approves and merges the open #AutoCascade pull requests built from the commit once
+// its builds pass
+func (service *BitbucketService) OnCommitStatus(payload *RepoCommitStatusCreatedPayload) error {
+	log.Println("--------- START OnCommitStatus ---------")
+
+	settings := service.Registry.For(payload.Repository.FullName)
+	if !settings.AutoMerge {
+		log.Println("SKIP Auto Merge (disabled for repository) -> ", payload.Repository.FullName)
+		return nil
+	}
+	// Only a success can complete the set of required builds
+	if payload.CommitStatus.State != "SUCCESSFUL" {
+		log.Println("SKIP build status -> ", payload.CommitStatus.Key, payload.CommitStatus.State)
+		return nil
+	}
+	if settings.DryRun && service.plan == nil {
+		_, err := service.runPlanned(payload.Repository.FullName, payload.CommitStatus.Refname, func(dry *BitbucketService) error {
+			return dry.OnCommitStatus(payload)
+		})
+		return err
+	}
+
+	commitHash := payload.CommitHash()
+	repoOwner := payload.Repository.Owner.UUID
+	repoName := payload.Repository.Name
+	log.Println("Commit: ", commitHash, " build: ", payload.CommitStatus.Key)
+
+	pullRequests, err := service.bitbucketAPI.ListPullRequests(repoOwner, repoName, PullRequestFilter{
+		TitleContains: "#AutoCascade",
+		State:         "OPEN",
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := range pullRequests {
+		pr := &pullRequests[i]
+		if !sameCommit(pr.Source.Commit.Hash, commitHash) {
+			continue
+		}
+		log.Println("Build status for PR ", pr.ID, " -> ", pr.Destination.Branch.Name)
+		if err := service.ApprovePullRequest(settings, repoOwner, repoName, pr); err != nil {
+			return err
+		}
+	}
+
+	log.Println("--------- End OnCommitStatus ---------")
+	return nil
+}
@@ -0,0 +1,424 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+)
+
+// CascadeStage is a single step of the cascade pipeline, e.g. "qa" or "release"
+type CascadeStage struct {
+	Name string `json:"name" yaml:"name"`
+	// Pattern is a glob matched against the whole branch name, "*" matches any characters (including "/")
+	Pattern string `json:"pattern" yaml:"pattern"`
+	// Next lists the stages merges cascade into. Defaults to the following stage in the list.
+	Next []string `json:"next" yaml:"next"`
+	// FanOut cascades into every branch of the next stage instead of only the branches of the same site
+	FanOut bool `json:"fan_out" yaml:"fan_out"`
+	// RequiredBuilds are the commit status keys that must be SUCCESSFUL before auto merging into the
+	// stage. Without any, at least one build must be reported on the commit and all must be SUCCESSFUL.
+	RequiredBuilds []string `json:"required_builds" yaml:"required_builds"`
+	// MergeStrategy is merge_commit, squash or fast_forward, empty uses the branch default. squash is
+	// only allowed on stages no other stage cascades into
+	MergeStrategy string `json:"merge_strategy" yaml:"merge_strategy"`
+	// Reviewers are added to the cascade pull requests into the stage, reviewer group names or user IDs
+	Reviewers []string `json:"reviewers" yaml:"reviewers"`
+
+	matcher *regexp.Regexp
+}
+
+// CascadeConfig is the ordered list of stages a merged change flows through
+type CascadeConfig struct {
+	Stages []*CascadeStage `json:"stages" yaml:"stages"`
+
+	next map[string][]*CascadeStage
+}
+
+// RepositoryConfig is the cascade settings of a repository as written in the config file.
+// Empty fields inherit from the top-level defaults.
+type RepositoryConfig struct {
+	DevelopmentBranchName string          `json:"development_branch" yaml:"development_branch"`
+	ReleaseBranchPrefix   string          `json:"release_branch_prefix" yaml:"release_branch_prefix"`
+	AutoMerge             *bool           `json:"auto_merge" yaml:"auto_merge"`
+	DryRun                *bool           `json:"dry_run" yaml:"dry_run"`
+	ConflictMarker        string          `json:"conflict_marker" yaml:"conflict_marker"`
+	ConflictBranches      *bool           `json:"conflict_branches" yaml:"conflict_branches"`
+	ReleaseTrain          *bool           `json:"release_train" yaml:"release_train"`
+	Policy                *PolicyConfig   `json:"policy" yaml:"policy"`
+	BranchGrammar         string          `json:"branch_grammar" yaml:"branch_grammar"`
+	Reviewers             *ReviewerConfig `json:"reviewers" yaml:"reviewers"`
+	DescriptionTemplate   string          `json:"description_template" yaml:"description_template"`
+	Stages                []*CascadeStage `json:"stages" yaml:"stages"`
+}
+
+// CascadeFile is the layout of the CASCADE_CONFIG file: default settings plus overrides keyed by
+// repository full name ("workspace/repo_slug")
+type CascadeFile struct {
+	RepositoryConfig `yaml:",inline"`
+	Repositories     map[string]*RepositoryConfig `json:"repositories" yaml:"repositories"`
+}
+
+// RepositorySettings is the resolved cascade settings of a repository
+type RepositorySettings struct {
+	DevelopmentBranchName string
+	ReleaseBranchPrefix   string
+	AutoMerge             bool
+	// DryRun plans the cascade (see PlanMerge) instead of calling the mutating Bitbucket APIs
+	DryRun bool
+	// ConflictMarker is appended to the title of cascade pull requests blocked by merge conflicts
+	ConflictMarker string
+	// ConflictBranches moves conflicting cascades onto a cascade/<src>-to-<dest>-<shortsha> branch
+	ConflictBranches bool
+	// ReleaseTrain cascades merges into a release branch into the next newer release branch, the
+	// newest into the development branch (see ReleaseTrainNextTarget)
+	ReleaseTrain bool
+	Policy       *BranchPolicy
+	// Grammar reads the site of branch names, branches of the same site cascade into each other
+	Grammar   *BranchGrammar
+	Reviewers ReviewerSettings
+	// Description renders the descriptions of cascade pull requests from a DescriptionData
+	Description *template.Template
+	Pipeline    *CascadeConfig
+
+	// policyConfig is the configured rules, inherited by the repositories, without the defaults
+	policyConfig PolicyConfig
+}
+
+// CascadeRegistry looks up the settings of the repository a webhook came from
+type CascadeRegistry struct {
+	defaults     *RepositorySettings
+	repositories map[string]*RepositorySettings
+}
+
+// DefaultCascadeConfig mirrors the historical develop -> dev -> qa -> uat -> release flow
+func DefaultCascadeConfig(developmentBranchName string, releaseBranchPrefix string) (*CascadeConfig, error) {
+	config := &CascadeConfig{
+		Stages: []*CascadeStage{
+			{Name: "develop", Pattern: developmentBranchName, FanOut: true},
+			{Name: "dev", Pattern: "dev*"},
+			{Name: "qa", Pattern: "qa*"},
+			{Name: "uat", Pattern: "uat*"},
+			{Name: "release", Pattern: releaseBranchPrefix + "*"},
+		},
+	}
+	return config, config.Validate()
+}
+
+// LoadCascadeRegistry reads a YAML or JSON (by .json extension) cascade config file on top of the
+// environment defaults. An empty path yields a registry where every repository uses the defaults.
+func LoadCascadeRegistry(path string, defaults RepositorySettings) (*CascadeRegistry, error) {
+	var file CascadeFile
+
+	if path != "" {
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if strings.EqualFold(filepath.Ext(path), ".json") {
+			err = json.Unmarshal(buf, &file)
+		} else {
+			err = yaml.Unmarshal(buf, &file)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cascade config %s: %v", path, err)
+		}
+	}
+
+	registry, err := NewCascadeRegistry(&file, defaults)
+	if err != nil && path != "" {
+		return nil, fmt.Errorf("cascade config %s: %v", path, err)
+	}
+	return registry, err
+}
+
+// NewCascadeRegistry resolves and validates the default and per-repository settings
+func NewCascadeRegistry(file *CascadeFile, base RepositorySettings) (*CascadeRegistry, error) {
+	defaults, err := resolveSettings(base, &file.RepositoryConfig, nil)
+	if err != nil {
+		return nil, fmt.Errorf("default settings: %v", err)
+	}
+
+	registry := &CascadeRegistry{
+		defaults:     defaults,
+		repositories: make(map[string]*RepositorySettings, len(file.Repositories)),
+	}
+	for fullName, config := range file.Repositories {
+		if config == nil {
+			config = &RepositoryConfig{}
+		}
+		settings, err := resolveSettings(*defaults, config, file.Stages)
+		if err != nil {
+			return nil, fmt.Errorf("repository %s: %v", fullName, err)
+		}
+		registry.repositories[strings.ToLower(fullName)] = settings
+	}
+	return registry, nil
+}
+
+// For returns the settings of a repository by full name, falling back on the defaults
+func (registry *CascadeRegistry) For(fullName string) *RepositorySettings {
+	if settings, ok := registry.repositories[strings.ToLower(fullName)]; ok {
+		return settings
+	}
+	return registry.defaults
+}
+
+// Repositories returns the full names of the repositories with their own settings
+func (registry *CascadeRegistry) Repositories() []string {
+	fullNames := make([]string, 0, len(registry.repositories))
+	for fullName := range registry.repositories {
+		fullNames = append(fullNames, fullName)
+	}
+	sort.Strings(fullNames)
+	return fullNames
+}
+
+// resolveSettings overlays config on base. Repositories without their own stages inherit the
+// top-level stages, retargeted on their own development branch and release prefix, or when none are
+// declared get the default flow for their branch names.
+func resolveSettings(base RepositorySettings, config *RepositoryConfig, inherited []*CascadeStage) (*RepositorySettings, error) {
+	settings := base
+	if config.DevelopmentBranchName != "" {
+		settings.DevelopmentBranchName = config.DevelopmentBranchName
+	}
+	if config.ReleaseBranchPrefix != "" {
+		settings.ReleaseBranchPrefix = config.ReleaseBranchPrefix
+	}
+	if config.AutoMerge != nil {
+		settings.AutoMerge = *config.AutoMerge
+	}
+	if config.DryRun != nil {
+		settings.DryRun = *config.DryRun
+	}
+	if config.ConflictMarker != "" {
+		settings.ConflictMarker = config.ConflictMarker
+	}
+	if config.ConflictBranches != nil {
+		settings.ConflictBranches = *config.ConflictBranches
+	}
+	if config.ReleaseTrain != nil {
+		settings.ReleaseTrain = *config.ReleaseTrain
+	}
+
+	settings.Reviewers = base.Reviewers.overlay(config.Reviewers)
+
+	// The default rules depend on the repository's release branch prefix
+	var err error
+	settings.policyConfig = base.policyConfig.overlay(config.Policy)
+	settings.Policy, err = NewBranchPolicy(DefaultPolicyConfig(settings.ReleaseBranchPrefix).overlay(&settings.policyConfig))
+	if err != nil {
+		return nil, fmt.Errorf("policy: %v", err)
+	}
+
+	if config.BranchGrammar != "" || settings.Grammar == nil {
+		expr := config.BranchGrammar
+		if expr == "" {
+			expr = DefaultBranchGrammar
+		}
+		if settings.Grammar, err = NewBranchGrammar(expr); err != nil {
+			return nil, fmt.Errorf("branch_grammar: %v", err)
+		}
+	}
+
+	if config.DescriptionTemplate != "" || settings.Description == nil {
+		text := config.DescriptionTemplate
+		if text == "" {
+			text = DefaultDescriptionTemplate
+		}
+		if settings.Description, err = NewDescriptionTemplate(text); err != nil {
+			return nil, fmt.Errorf("description_template: %v", err)
+		}
+	}
+
+	stages := config.Stages
+	if len(stages) == 0 {
+		stages = retargetStages(inherited, base, settings)
+	}
+
+	if len(stages) > 0 {
+		settings.Pipeline = &CascadeConfig{Stages: stages}
+		err = settings.Pipeline.Validate()
+	} else {
+		settings.Pipeline, err = DefaultCascadeConfig(settings.DevelopmentBranchName, settings.ReleaseBranchPrefix)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &settings, nil
+}
+
+// retargetStages copies the inherited stages, replacing the development branch and release branch
+// patterns of base by the ones of settings
+func retargetStages(stages []*CascadeStage, base RepositorySettings, settings RepositorySettings) []*CascadeStage {
+	retargeted := make([]*CascadeStage, 0, len(stages))
+	for _, stage := range stages {
+		copied := *stage
+		switch copied.Pattern {
+		case base.DevelopmentBranchName:
+			copied.Pattern = settings.DevelopmentBranchName
+		case base.ReleaseBranchPrefix + "*":
+			copied.Pattern = settings.ReleaseBranchPrefix + "*"
+		}
+		retargeted = append(retargeted, &copied)
+	}
+	return retargeted
+}
+
+// Validate checks the stage graph (unique names, known next stages, no cycles, no squash merges into a
+// stage cascaded into) and prepares it for lookups
+func (config *CascadeConfig) Validate() error {
+	if len(config.Stages) == 0 {
+		return fmt.Errorf("no stages defined")
+	}
+
+	byName := make(map[string]*CascadeStage, len(config.Stages))
+	for i, stage := range config.Stages {
+		if stage == nil || stage.Name == "" {
+			return fmt.Errorf("stage %d has no name", i)
+		}
+		if _, ok := byName[stage.Name]; ok {
+			return fmt.Errorf("stage %q is defined more than once", stage.Name)
+		}
+		if stage.Pattern == "" {
+			return fmt.Errorf("stage %q has no pattern", stage.Name)
+		}
+		matcher, err := compileBranchPattern(stage.Pattern)
+		if err != nil {
+			return fmt.Errorf("stage %q: %v", stage.Name, err)
+		}
+		switch stage.MergeStrategy {
+		case "", "merge_commit", "squash", "fast_forward":
+		default:
+			return fmt.Errorf("stage %q: unknown merge strategy %q", stage.Name, stage.MergeStrategy)
+		}
+		stage.matcher = matcher
+		byName[stage.Name] = stage
+	}
+
+	config.next = make(map[string][]*CascadeStage, len(config.Stages))
+	for i, stage := range config.Stages {
+		if len(stage.Next) == 0 {
+			if i+1 < len(config.Stages) {
+				config.next[stage.Name] = []*CascadeStage{config.Stages[i+1]}
+			}
+			continue
+		}
+		for _, name := range stage.Next {
+			next, ok := byName[name]
+			if !ok {
+				return fmt.Errorf("stage %q cascades into unknown stage %q", stage.Name, name)
+			}
+			config.next[stage.Name] = append(config.next[stage.Name], next)
+		}
+	}
+
+	//Drift is detected by commit reachability, a squash merge leaves the upstream commits unreachable
+	//so the drift check would keep reopening "Missed cascade" pull requests
+	for _, stage := range config.Stages {
+		for _, next := range config.next[stage.Name] {
+			if next.MergeStrategy == "squash" {
+				return fmt.Errorf("stage %q: merge strategy squash is not allowed on a stage cascaded into from %q", next.Name, stage.Name)
+			}
+		}
+	}
+
+	// Depth-first search for back edges
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int, len(config.Stages))
+	var visit func(stage *CascadeStage, path []string) error
+	visit = func(stage *CascadeStage, path []string) error {
+		path = append(path, stage.Name)
+		switch state[stage.Name] {
+		case visiting:
+			return fmt.Errorf("cycle detected: %s", strings.Join(path, " -> "))
+		case visited:
+			return nil
+		}
+		state[stage.Name] = visiting
+		for _, next := range config.next[stage.Name] {
+			if err := visit(next, path); err != nil {
+				return err
+			}
+		}
+		state[stage.Name] = visited
+		return nil
+	}
+	for _, stage := range config.Stages {
+		if err := visit(stage, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// StageFor returns the first stage whose pattern matches the branch, or nil
+func (config *CascadeConfig) StageFor(branchName string) *CascadeStage {
+	for _, stage := range config.Stages {
+		if stage.matcher.MatchString(branchName) {
+			return stage
+		}
+	}
+	return nil
+}
+
+// StageNamed returns the stage called name, or nil
+func (config *CascadeConfig) StageNamed(name string) *CascadeStage {
+	for _, stage := range config.Stages {
+		if stage.Name == name {
+			return stage
+		}
+	}
+	return nil
+}
+
+// NextStages returns the stages a merge into the given stage cascades into
+func (config *CascadeConfig) NextStages(stage *CascadeStage) []*CascadeStage {
+	return config.next[stage.Name]
+}
+
+// IsNext reports whether "to" directly follows "from" in the pipeline
+func (config *CascadeConfig) IsNext(from *CascadeStage, to *CascadeStage) bool {
+	for _, next := range config.NextStages(from) {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// NameFilter returns the literal prefix of every stage pattern, for narrowing branch listings server
+// side. It is empty, meaning no filtering, when a pattern starts with a wildcard.
+func (config *CascadeConfig) NameFilter() []string {
+	var filter []string
+	for _, stage := range config.Stages {
+		prefix := stage.Pattern
+		if i := strings.IndexAny(prefix, "*?"); i >= 0 {
+			prefix = prefix[:i]
+		}
+		if prefix == "" {
+			return nil
+		}
+		filter = append(filter, prefix)
+	}
+	return filter
+}
+
+// compileBranchPattern turns a glob ("*" any characters, "?" one character) into an anchored regexp
+func compileBranchPattern(pattern string) (*regexp.Regexp, error) {
+	expr := regexp.QuoteMeta(pattern)
+	expr = strings.ReplaceAll(expr, `\*`, ".*")
+	expr = strings.ReplaceAll(expr, `\?`, ".")
+	return regexp.Compile("^" + expr + "$")
+}
@@ -0,0 +1,294 @@
+package internal
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testSettings returns the default settings of a repository using develop and release/
+func testSettings(t *testing.T) *RepositorySettings {
+	t.Helper()
+	registry, err := NewCascadeRegistry(&CascadeFile{}, RepositorySettings{
+		DevelopmentBranchName: "develop",
+		ReleaseBranchPrefix:   "release/",
+		AutoMerge:             true,
+		ConflictMarker:        "[CONFLICT]",
+		ConflictBranches:      true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return registry.For("workspace/repo")
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		stages []*CascadeStage
+		err    string
+	}{
+		{
+			name: "default flow",
+			stages: []*CascadeStage{
+				{Name: "develop", Pattern: "develop", FanOut: true},
+				{Name: "dev", Pattern: "dev/*"},
+				{Name: "qa", Pattern: "qa/*", MergeStrategy: "merge_commit"},
+				{Name: "release", Pattern: "release/*", MergeStrategy: "fast_forward"},
+			},
+		},
+		{
+			name:   "no stages",
+			stages: nil,
+			err:    "no stages defined",
+		},
+		{
+			name: "cycle",
+			stages: []*CascadeStage{
+				{Name: "dev", Pattern: "dev/*", Next: []string{"qa"}},
+				{Name: "qa", Pattern: "qa/*", Next: []string{"dev"}},
+			},
+			err: "cycle detected",
+		},
+		{
+			name: "self cycle",
+			stages: []*CascadeStage{
+				{Name: "dev", Pattern: "dev/*", Next: []string{"dev"}},
+			},
+			err: "cycle detected",
+		},
+		{
+			name: "unknown next stage",
+			stages: []*CascadeStage{
+				{Name: "dev", Pattern: "dev/*", Next: []string{"staging"}},
+			},
+			err: `unknown stage "staging"`,
+		},
+		{
+			name: "duplicate name",
+			stages: []*CascadeStage{
+				{Name: "dev", Pattern: "dev/*"},
+				{Name: "dev", Pattern: "qa/*"},
+			},
+			err: "defined more than once",
+		},
+		{
+			name: "missing name",
+			stages: []*CascadeStage{
+				{Pattern: "dev/*"},
+			},
+			err: "has no name",
+		},
+		{
+			name: "missing pattern",
+			stages: []*CascadeStage{
+				{Name: "dev"},
+			},
+			err: "has no pattern",
+		},
+		{
+			name: "bad merge strategy",
+			stages: []*CascadeStage{
+				{Name: "dev", Pattern: "dev/*", MergeStrategy: "rebase"},
+			},
+			err: `unknown merge strategy "rebase"`,
+		},
+		{
+			name: "squash into a stage cascaded into",
+			stages: []*CascadeStage{
+				{Name: "dev", Pattern: "dev/*"},
+				{Name: "qa", Pattern: "qa/*", MergeStrategy: "squash"},
+			},
+			err: `merge strategy squash is not allowed on a stage cascaded into from "dev"`,
+		},
+		{
+			name: "squash into a stage cascaded into by next",
+			stages: []*CascadeStage{
+				{Name: "dev", Pattern: "dev/*", Next: []string{"release"}},
+				{Name: "qa", Pattern: "qa/*"},
+				{Name: "release", Pattern: "release/*", MergeStrategy: "squash"},
+			},
+			err: `merge strategy squash is not allowed on a stage cascaded into from "dev"`,
+		},
+		{
+			name: "squash into the first stage",
+			stages: []*CascadeStage{
+				{Name: "develop", Pattern: "develop", MergeStrategy: "squash"},
+				{Name: "dev", Pattern: "dev/*"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := (&CascadeConfig{Stages: test.stages}).Validate()
+			if test.err == "" {
+				if err != nil {
+					t.Fatalf("Validate() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("Validate() = %v, want error containing %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestDefaultCascadeConfig(t *testing.T) {
+	config, err := DefaultCascadeConfig("develop", "release/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		branch string
+		stage  string
+		next   []string
+	}{
+		{"develop", "develop", []string{"dev"}},
+		{"dev/acme", "dev", []string{"qa"}},
+		{"qa/acme", "qa", []string{"uat"}},
+		{"uat/acme", "uat", []string{"release"}},
+		{"release/2020.12.0", "release", nil},
+		{"feature/x", "", nil},
+	}
+	for _, test := range tests {
+		stage := config.StageFor(test.branch)
+		if test.stage == "" {
+			if stage != nil {
+				t.Errorf("StageFor(%q) = %q, want none", test.branch, stage.Name)
+			}
+			continue
+		}
+		if stage == nil || stage.Name != test.stage {
+			t.Errorf("StageFor(%q) = %v, want %q", test.branch, stage, test.stage)
+			continue
+		}
+		var next []string
+		for _, stage := range config.NextStages(stage) {
+			next = append(next, stage.Name)
+		}
+		if !reflect.DeepEqual(next, test.next) {
+			t.Errorf("NextStages(%q) = %v, want %v", test.stage, next, test.next)
+		}
+	}
+}
+
+func TestRepositoriesInheritStagesOnTheirOwnBranches(t *testing.T) {
+	stages := []*CascadeStage{
+		{Name: "develop", Pattern: "develop", FanOut: true},
+		{Name: "qa", Pattern: "qa/*"},
+		{Name: "release", Pattern: "release/*"},
+	}
+	repositories := map[string]*RepositoryConfig{
+		"workspace/main": {DevelopmentBranchName: "main", ReleaseBranchPrefix: "rel/"},
+		"workspace/repo": nil,
+	}
+
+	tests := []struct {
+		name       string
+		stages     []*CascadeStage
+		repository string
+		branches   map[string]string
+	}{
+		{name: "top-level stages", stages: stages, repository: "workspace/main",
+			branches: map[string]string{"main": "develop", "develop": "", "qa/acme": "qa", "rel/1.0": "release", "release/1.0": ""}},
+		{name: "top-level stages kept", stages: stages, repository: "workspace/repo",
+			branches: map[string]string{"develop": "develop", "main": "", "release/1.0": "release"}},
+		{name: "default stages", repository: "workspace/main",
+			branches: map[string]string{"main": "develop", "uat/acme": "uat", "rel/1.0": "release", "release/1.0": ""}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := &CascadeFile{RepositoryConfig: RepositoryConfig{Stages: test.stages}, Repositories: repositories}
+			registry, err := NewCascadeRegistry(file, RepositorySettings{DevelopmentBranchName: "develop", ReleaseBranchPrefix: "release/"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			settings := registry.For(test.repository)
+			for branch, want := range test.branches {
+				stage := ""
+				if found := settings.Pipeline.StageFor(branch); found != nil {
+					stage = found.Name
+				}
+				if stage != want {
+					t.Errorf("StageFor(%q) = %q, want %q", branch, stage, want)
+				}
+			}
+			// The top-level stages are left as declared
+			if stages[0].Pattern != "develop" || stages[2].Pattern != "release/*" {
+				t.Errorf("top-level stages changed: %q, %q", stages[0].Pattern, stages[2].Pattern)
+			}
+		})
+	}
+}
+
+func TestNextTargets(t *testing.T) {
+	settings := testSettings(t)
+	service := &BitbucketService{}
+	branches := []string{
+		"develop",
+		"dev/acme", "dev/globex",
+		"qa/acme", "qa/globex",
+		"uat/acme", "uat/globex",
+		"release/acme_1.0", "release/globex_1.0",
+		"prod/acme",
+		"feature/x",
+	}
+	targets := make([]Branch, 0, len(branches))
+	for _, name := range branches {
+		targets = append(targets, settings.ParseBranch(name))
+	}
+
+	tests := []struct {
+		name   string
+		branch string
+		next   []string
+	}{
+		{"develop fans out to every site", "develop", []string{"dev/acme", "dev/globex"}},
+		{"dev into qa of the same site", "dev/acme", []string{"qa/acme"}},
+		{"qa into uat of the same site", "qa/globex", []string{"uat/globex"}},
+		{"uat into release", "uat/acme", []string{"release/acme_1.0"}},
+		{"release is the last stage", "release/acme_1.0", nil},
+		{"branches outside the pipeline", "feature/x", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			next := service.NextTargets(settings, settings.ParseBranch(test.branch), targets)
+			if !reflect.DeepEqual(next, test.next) {
+				t.Errorf("NextTargets(%q) = %v, want %v", test.branch, next, test.next)
+			}
+			site := service.SiteSpecificNextTarget(settings, settings.ParseBranch(test.branch), targets)
+			want := ""
+			if len(test.next) > 0 {
+				want = test.next[0]
+			}
+			if site != want {
+				t.Errorf("SiteSpecificNextTarget(%q) = %q, want %q", test.branch, site, want)
+			}
+		})
+	}
+}
+
+func TestNextTargetsExcludesNeverTarget(t *testing.T) {
+	file := &CascadeFile{RepositoryConfig: RepositoryConfig{Stages: []*CascadeStage{
+		{Name: "uat", Pattern: "uat/*"},
+		{Name: "prod", Pattern: "prod/*"},
+	}}}
+	registry, err := NewCascadeRegistry(file, RepositorySettings{DevelopmentBranchName: "develop", ReleaseBranchPrefix: "release/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := registry.For("workspace/repo")
+	service := &BitbucketService{}
+	targets := []Branch{settings.ParseBranch("prod/acme")}
+
+	// prod/* is never targeted by default, even when the pipeline leads there
+	if next := service.NextTargets(settings, settings.ParseBranch("uat/acme"), targets); next != nil {
+		t.Errorf("NextTargets(uat/acme) = %v, want none", next)
+	}
+	if next := service.SiteSpecificNextTarget(settings, settings.ParseBranch("uat/acme"), targets); next != "" {
+		t.Errorf("SiteSpecificNextTarget(uat/acme) = %q, want none", next)
+	}
+}
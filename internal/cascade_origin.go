@@ -0,0 +1,151 @@
+package internal
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// CascadeOrigin is the pull request a cascade started from. Cascade pull requests are authored by
+// the bot, so the origin is recorded in their descriptions and carried along every hop.
+type CascadeOrigin struct {
+	// CascadeID correlates every pull request of the cascade, see CascadeID
+	CascadeID     string
+	PullRequestID int64
+	Author        Owner
+	// Approvers are the users who approved the original pull request
+	Approvers []Owner
+	// Path is the branches the change went through so far
+	Path []string
+	// PullRequest is the original pull request when known, it isn't recorded in descriptions
+	PullRequest *PullRequest
+}
+
+const authorLine = "Author: {%s}"
+const originLine = "Origin: #%d"
+const approversLine = "Approvers: %s"
+const pathLine = "Path: %s"
+const cascadeLine = "Cascade: %s"
+
+var authorPattern = regexp.MustCompile(`(?m)^Author: \{([^}]+)\}\s*$`)
+var originPattern = regexp.MustCompile(`(?m)^Origin: #(\d+)\s*$`)
+var approversPattern = regexp.MustCompile(`(?m)^Approvers: (.*)$`)
+var pathPattern = regexp.MustCompile(`(?m)^Path: (.*)$`)
+var cascadePattern = regexp.MustCompile(`(?m)^Cascade: ([0-9a-f]+)\s*$`)
+var accountPattern = regexp.MustCompile(`\{([^}]+)\}`)
+
+// OriginOf returns the origin recorded in a cascade pull request, or the pull request itself. Anyone
+// can write the origin lines in a description, they are only read from the #AutoCascade pull requests
+// opened by bot.
+func OriginOf(pr *PullRequest, bot *Owner) CascadeOrigin {
+	origin := CascadeOrigin{
+		PullRequestID: pr.ID,
+		Author:        pr.Author,
+		Path:          []string{pr.Source.Branch.Name, pr.Destination.Branch.Name},
+		PullRequest:   pr,
+	}
+	if match := lastMatch(originPattern, pr.Description); match != nil && isCascadePullRequest(pr, bot) {
+		origin.PullRequestID, _ = strconv.ParseInt(match[1], 10, 64)
+		origin.PullRequest = nil
+		if match := lastMatch(cascadePattern, pr.Description); match != nil {
+			origin.CascadeID = match[1]
+		}
+		if accountId := authorFromDescription(pr.Description); accountId != "" {
+			origin.Author = Owner{AccountId: accountId}
+		}
+		if match := lastMatch(pathPattern, pr.Description); match != nil {
+			origin.Path = strings.Split(strings.TrimSpace(match[1]), " -> ")
+		}
+		//The approvers of a cascade pull request are the bot
+		if match := lastMatch(approversPattern, pr.Description); match != nil {
+			for _, account := range accountPattern.FindAllStringSubmatch(match[1], -1) {
+				origin.Approvers = append(origin.Approvers, Owner{AccountId: account[1]})
+			}
+		}
+	} else {
+		for _, participant := range pr.Participants {
+			if participant.Approved {
+				origin.Approvers = append(origin.Approvers, participant.User)
+			}
+		}
+	}
+	return origin
+}
+
+// isCascadePullRequest reports whether pr is an #AutoCascade pull request opened by bot
+func isCascadePullRequest(pr *PullRequest, bot *Owner) bool {
+	return bot != nil && strings.HasPrefix(pr.Title, "#AutoCascade ") && sameAccount(pr.Author, *bot)
+}
+
+// sameAccount compares users by account ID or UUID, users without either are nobody
+func sameAccount(a Owner, b Owner) bool {
+	return (a.AccountId != "" && a.AccountId == b.AccountId) || (a.UUID != "" && a.UUID == b.UUID)
+}
+
+// originOf is OriginOf with the bot looked up. A pull request without the #AutoCascade title is its own
+// origin whoever the bot is, so only cascade pull requests fail when the bot can't be looked up.
+func (service *BitbucketService) originOf(pr *PullRequest) (CascadeOrigin, error) {
+	if !strings.HasPrefix(pr.Title, "#AutoCascade ") {
+		return OriginOf(pr, nil), nil
+	}
+	bot, err := service.currentUser()
+	if err != nil {
+		return CascadeOrigin{}, err
+	}
+	return OriginOf(pr, bot), nil
+}
+
+// Hop returns the origin of a cascade from src into dest, with dest added to the path
+func (origin CascadeOrigin) Hop(src string, dest string) CascadeOrigin {
+	path := append([]string(nil), origin.Path...)
+	if len(path) == 0 || path[len(path)-1] != src {
+		path = append(path, src)
+	}
+	origin.Path = append(path, dest)
+	return origin
+}
+
+// DescriptionLines renders the origin for a cascade pull request description
+func (origin CascadeOrigin) DescriptionLines() string {
+	var lines string
+	if origin.CascadeID != "" {
+		lines += fmt.Sprintf(cascadeLine, origin.CascadeID) + "\n"
+	}
+	if origin.PullRequestID > 0 {
+		lines += fmt.Sprintf(originLine, origin.PullRequestID) + "\n"
+	}
+	if origin.Author.AccountId != "" {
+		lines += fmt.Sprintf(authorLine, origin.Author.AccountId) + "\n"
+	}
+	var approvers []string
+	for _, approver := range origin.Approvers {
+		if approver.AccountId != "" {
+			approvers = append(approvers, "{"+approver.AccountId+"}")
+		}
+	}
+	if len(approvers) > 0 {
+		lines += fmt.Sprintf(approversLine, strings.Join(approvers, ", ")) + "\n"
+	}
+	if len(origin.Path) > 0 {
+		lines += fmt.Sprintf(pathLine, strings.Join(origin.Path, " -> ")) + "\n"
+	}
+	return lines
+}
+
+// authorFromDescription returns the account ID recorded by authorLine, empty when missing
+func authorFromDescription(description string) string {
+	if match := lastMatch(authorPattern, description); match != nil {
+		return match[1]
+	}
+	return ""
+}
+
+// lastMatch returns the submatches of the last match, the lines are appended after the templated text
+func lastMatch(pattern *regexp.Regexp, text string) []string {
+	matches := pattern.FindAllStringSubmatch(text, -1)
+	if len(matches) == 0 {
+		return nil
+	}
+	return matches[len(matches)-1]
+}
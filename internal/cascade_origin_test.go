@@ -0,0 +1,131 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+)
+
+var testBot = &Owner{UUID: "{cascade-bot}", AccountId: "cascade-bot"}
+
+// originLines are the lines of a cascade pull request of #1 by alice, approved by bob
+const originLines = "Cascade: 0123abcd\nOrigin: #1\nAuthor: {alice}\nApprovers: {bob}, {carol}\nPath: feature/x -> develop -> dev/acme\n"
+
+func testPullRequest(title string, author Owner, description string) *PullRequest {
+	pr := &PullRequest{ID: 5, Title: title, Author: author, Description: description}
+	pr.Source.Branch.Name = "dev/acme"
+	pr.Destination.Branch.Name = "qa/acme"
+	pr.Participants = []Participant{{User: Owner{AccountId: "dave"}, Approved: true}, {User: Owner{AccountId: "erin"}}}
+	return pr
+}
+
+func TestOriginOf(t *testing.T) {
+	human := Owner{AccountId: "mallory"}
+
+	tests := []struct {
+		name string
+		pr   *PullRequest
+		bot  *Owner
+		want CascadeOrigin
+	}{
+		{
+			name: "cascade pull request",
+			pr:   testPullRequest("#AutoCascade Add the feature", *testBot, "Cascade of #1\n\n"+originLines),
+			bot:  testBot,
+			want: CascadeOrigin{CascadeID: "0123abcd", PullRequestID: 1, Author: Owner{AccountId: "alice"},
+				Approvers: []Owner{{AccountId: "bob"}, {AccountId: "carol"}}, Path: []string{"feature/x", "develop", "dev/acme"}},
+		},
+		{
+			name: "the last lines win",
+			pr:   testPullRequest("#AutoCascade Add the feature", *testBot, "Origin: #9\nCascade: ffff\n\n"+originLines),
+			bot:  testBot,
+			want: CascadeOrigin{CascadeID: "0123abcd", PullRequestID: 1, Author: Owner{AccountId: "alice"},
+				Approvers: []Owner{{AccountId: "bob"}, {AccountId: "carol"}}, Path: []string{"feature/x", "develop", "dev/acme"}},
+		},
+		{
+			name: "matched by UUID",
+			pr:   testPullRequest("#AutoCascade Add the feature", Owner{UUID: "{cascade-bot}"}, originLines),
+			bot:  testBot,
+			want: CascadeOrigin{CascadeID: "0123abcd", PullRequestID: 1, Author: Owner{AccountId: "alice"},
+				Approvers: []Owner{{AccountId: "bob"}, {AccountId: "carol"}}, Path: []string{"feature/x", "develop", "dev/acme"}},
+		},
+		{
+			name: "human pull request",
+			pr:   testPullRequest("Add the feature", human, "Just a change"),
+			bot:  testBot,
+			want: CascadeOrigin{PullRequestID: 5, Author: human, Approvers: []Owner{{AccountId: "dave"}}, Path: []string{"dev/acme", "qa/acme"}},
+		},
+		{
+			name: "human pull request with origin lines",
+			pr:   testPullRequest("Add the feature", human, originLines),
+			bot:  testBot,
+			want: CascadeOrigin{PullRequestID: 5, Author: human, Approvers: []Owner{{AccountId: "dave"}}, Path: []string{"dev/acme", "qa/acme"}},
+		},
+		{
+			name: "human pull request with the cascade title",
+			pr:   testPullRequest("#AutoCascade Add the feature", human, originLines),
+			bot:  testBot,
+			want: CascadeOrigin{PullRequestID: 5, Author: human, Approvers: []Owner{{AccountId: "dave"}}, Path: []string{"dev/acme", "qa/acme"}},
+		},
+		{
+			name: "bot pull request without the cascade title",
+			pr:   testPullRequest("Release notes", *testBot, originLines),
+			bot:  testBot,
+			want: CascadeOrigin{PullRequestID: 5, Author: *testBot, Approvers: []Owner{{AccountId: "dave"}}, Path: []string{"dev/acme", "qa/acme"}},
+		},
+		{
+			name: "unknown bot",
+			pr:   testPullRequest("#AutoCascade Add the feature", *testBot, originLines),
+			bot:  nil,
+			want: CascadeOrigin{PullRequestID: 5, Author: *testBot, Approvers: []Owner{{AccountId: "dave"}}, Path: []string{"dev/acme", "qa/acme"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			origin := OriginOf(test.pr, test.bot)
+			if origin.PullRequestID == test.pr.ID {
+				test.want.PullRequest = test.pr
+			}
+			if !reflect.DeepEqual(origin, test.want) {
+				t.Errorf("OriginOf() = %+v, want %+v", origin, test.want)
+			}
+		})
+	}
+}
+
+func TestOriginDescriptionLinesRoundTrip(t *testing.T) {
+	origin := CascadeOrigin{CascadeID: "0123abcd", PullRequestID: 1, Author: Owner{AccountId: "alice"},
+		Approvers: []Owner{{AccountId: "bob"}}, Path: []string{"feature/x", "develop"}}
+	hop := origin.Hop("develop", "dev/acme")
+	if want := []string{"feature/x", "develop", "dev/acme"}; !reflect.DeepEqual(hop.Path, want) {
+		t.Errorf("Hop().Path = %v, want %v", hop.Path, want)
+	}
+	if want := []string{"feature/x", "develop"}; !reflect.DeepEqual(origin.Path, want) {
+		t.Errorf("Hop() changed the path to %v", origin.Path)
+	}
+
+	pr := testPullRequest("#AutoCascade Add the feature", *testBot, "Cascade of #1\n\n"+hop.DescriptionLines())
+	if parsed := OriginOf(pr, testBot); !reflect.DeepEqual(parsed, hop) {
+		t.Errorf("OriginOf(DescriptionLines()) = %+v, want %+v", parsed, hop)
+	}
+}
+
+func TestCascadeAuthor(t *testing.T) {
+	service, _ := newTestService(t, nil)
+
+	tests := []struct {
+		name string
+		pr   *PullRequest
+		want string
+	}{
+		{"cascade pull request", testPullRequest("#AutoCascade Add the feature", *testBot, originLines), "alice"},
+		{"human pull request with an author line", testPullRequest("Add the feature", Owner{AccountId: "mallory"}, originLines), ""},
+		{"human pull request with the cascade title", testPullRequest("#AutoCascade Add the feature", Owner{AccountId: "mallory"}, originLines), ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if author := service.cascadeAuthor(test.pr); author != test.want {
+				t.Errorf("cascadeAuthor() = %q, want %q", author, test.want)
+			}
+		})
+	}
+}
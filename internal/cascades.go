@@ -0,0 +1,424 @@
+package internal
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CascadeHop is a cascade pull request
+type CascadeHop struct {
+	PullRequestID int64  `json:"pull_request_id"`
+	Source        string `json:"source"`
+	Destination   string `json:"destination"`
+	// State is the pull request state: OPEN, MERGED or DECLINED
+	State     string    `json:"state"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Replaces is the pull request this one continues, e.g. from a conflict branch
+	Replaces int64 `json:"replaces,omitempty"`
+	// WaitingForBuilds is set while an auto merge waits for the builds of the source commit
+	WaitingForBuilds bool `json:"waiting_for_builds,omitempty"`
+}
+
+// Cascade is a merged change and every cascade pull request it led to, across all sites
+type Cascade struct {
+	ID         string `json:"id"`
+	Repository string `json:"repository"`
+	// PullRequestID is the original pull request
+	PullRequestID int64     `json:"pull_request_id"`
+	Title         string    `json:"title"`
+	Author        string    `json:"author,omitempty"`
+	Source        string    `json:"source"`
+	Destination   string    `json:"destination"`
+	StartedAt     time.Time `json:"started_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+	// MergedAt is when the original pull request merged, the lead time is measured from there
+	MergedAt time.Time `json:"merged_at"`
+	// ReleasedAt is when the change first merged into a release branch
+	ReleasedAt time.Time     `json:"released_at"`
+	Hops       []*CascadeHop `json:"hops"`
+}
+
+// CascadeNode is a branch of the cascade tree with the pull request that brought the change there
+type CascadeNode struct {
+	Branch   string         `json:"branch"`
+	Hop      *CascadeHop    `json:"hop,omitempty"`
+	Children []*CascadeNode `json:"children"`
+}
+
+// CascadeTree is a cascade with its hops arranged from the branch the original pull request merged into
+type CascadeTree struct {
+	*Cascade
+	Tree *CascadeNode `json:"tree"`
+}
+
+// CascadeID identifies the cascade of an original pull request. It is derived from the pull request so
+// retried webhooks and the cascade pull requests created before IDs existed end up with the same one.
+func CascadeID(repository string, pullRequestId int64) string {
+	sum := sha1.Sum([]byte(strings.ToLower(repository) + "#" + strconv.FormatInt(pullRequestId, 10)))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// maxCascades bounds the store, the least recently updated cascades are dropped first
+const maxCascades = 1000
+
+// CascadeStore keeps the cascades and their hops. It is saved to a file so they survive restarts.
+type CascadeStore struct {
+	path string
+
+	mu       sync.Mutex
+	cascades map[string]*Cascade
+	// hops finds the cascade of a pull request, keyed by lowercased repository#id
+	hops map[string]string
+}
+
+func NewCascadeStore(path string) (*CascadeStore, error) {
+	store := &CascadeStore{
+		path:     path,
+		cascades: make(map[string]*Cascade),
+		hops:     make(map[string]string),
+	}
+
+	buf, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(buf, &store.cascades); err != nil {
+			log.Println("CascadeStore -> ignoring unreadable file: ", path, err)
+			store.cascades = make(map[string]*Cascade)
+		}
+	}
+	for _, cascade := range store.cascades {
+		for _, hop := range cascade.Hops {
+			store.hops[blockedKey(cascade.Repository, hop.PullRequestID)] = cascade.ID
+		}
+	}
+	return store, nil
+}
+
+// Start records a cascade unless it is already known
+func (store *CascadeStore) Start(cascade *Cascade) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, ok := store.cascades[cascade.ID]; ok {
+		return
+	}
+	store.cascades[cascade.ID] = cascade
+	store.save()
+}
+
+// AddHop records a cascade pull request, once
+func (store *CascadeStore) AddHop(cascadeId string, hop *CascadeHop) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	cascade, ok := store.cascades[cascadeId]
+	if !ok {
+		log.Println("CascadeStore -> unknown cascade: ", cascadeId)
+		return
+	}
+	key := blockedKey(cascade.Repository, hop.PullRequestID)
+	if _, ok := store.hops[key]; ok {
+		return
+	}
+	cascade.Hops = append(cascade.Hops, hop)
+	cascade.UpdatedAt = hop.UpdatedAt
+	store.hops[key] = cascade.ID
+	store.save()
+}
+
+// UpdateHop changes the state of a cascade pull request and returns a copy of its cascade, nil when
+// the state didn't change or the pull request isn't tracked
+func (store *CascadeStore) UpdateHop(repository string, pullRequestId int64, state string, at time.Time) *Cascade {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	cascade, ok := store.cascades[store.hops[blockedKey(repository, pullRequestId)]]
+	if !ok {
+		return nil
+	}
+	for _, hop := range cascade.Hops {
+		if hop.PullRequestID == pullRequestId && hop.State != state {
+			hop.State = state
+			hop.WaitingForBuilds = false
+			hop.UpdatedAt = at
+			cascade.UpdatedAt = at
+			store.save()
+			return cascade.copy()
+		}
+	}
+	return nil
+}
+
+// Release records the first merge of the cascade into a release branch. It returns false when the
+// cascade is unknown or already released.
+func (store *CascadeStore) Release(id string, at time.Time) bool {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	cascade, ok := store.cascades[id]
+	if !ok || !cascade.ReleasedAt.IsZero() {
+		return false
+	}
+	cascade.ReleasedAt = at
+	store.save()
+	return true
+}
+
+// SetWaiting flags a cascade pull request waiting for builds, untracked pull requests are ignored
+func (store *CascadeStore) SetWaiting(repository string, pullRequestId int64, waiting bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	cascade, ok := store.cascades[store.hops[blockedKey(repository, pullRequestId)]]
+	if !ok {
+		return
+	}
+	for _, hop := range cascade.Hops {
+		if hop.PullRequestID == pullRequestId && hop.WaitingForBuilds != waiting {
+			hop.WaitingForBuilds = waiting
+			store.save()
+		}
+	}
+}
+
+// Get returns a copy of the cascade, nil when unknown
+func (store *CascadeStore) Get(id string) *Cascade {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	cascade, ok := store.cascades[id]
+	if !ok {
+		return nil
+	}
+	return cascade.copy()
+}
+
+// List returns copies of the cascades, most recently updated first
+func (store *CascadeStore) List() []*Cascade {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	cascades := make([]*Cascade, 0, len(store.cascades))
+	for _, cascade := range store.cascades {
+		cascades = append(cascades, cascade.copy())
+	}
+	sort.Slice(cascades, func(i, j int) bool {
+		return cascades[i].UpdatedAt.After(cascades[j].UpdatedAt)
+	})
+	return cascades
+}
+
+// save is best effort like the BlockedStore, dropping the oldest cascades over maxCascades first
+func (store *CascadeStore) save() {
+	if len(store.cascades) > maxCascades {
+		cascades := make([]*Cascade, 0, len(store.cascades))
+		for _, cascade := range store.cascades {
+			cascades = append(cascades, cascade)
+		}
+		sort.Slice(cascades, func(i, j int) bool {
+			return cascades[i].UpdatedAt.Before(cascades[j].UpdatedAt)
+		})
+		for _, cascade := range cascades[:len(cascades)-maxCascades] {
+			delete(store.cascades, cascade.ID)
+			for _, hop := range cascade.Hops {
+				delete(store.hops, blockedKey(cascade.Repository, hop.PullRequestID))
+			}
+		}
+	}
+
+	buf, err := json.Marshal(store.cascades)
+	if err == nil {
+		err = writeFileAtomic(store.path, buf)
+	}
+	if err != nil {
+		log.Println("CascadeStore -> could not save: ", err)
+	}
+}
+
+func (cascade *Cascade) copy() *Cascade {
+	copied := *cascade
+	copied.Hops = make([]*CascadeHop, len(cascade.Hops))
+	for i, hop := range cascade.Hops {
+		hopCopy := *hop
+		copied.Hops[i] = &hopCopy
+	}
+	return &copied
+}
+
+// source is the branch a hop brings the change from, for a hop replacing another one, e.g. from a
+// conflict branch, the branch the replaced one started from
+func (cascade *Cascade) source(hop *CascadeHop) string {
+	for seen := 0; hop.Replaces != 0 && seen < len(cascade.Hops); seen++ {
+		var replaced *CascadeHop
+		for _, other := range cascade.Hops {
+			if other.PullRequestID == hop.Replaces {
+				replaced = other
+			}
+		}
+		if replaced == nil {
+			break
+		}
+		hop = replaced
+	}
+	return hop.Source
+}
+
+// Tree arranges the hops by the branch they start from. A hop replacing another one hangs from the
+// branch the replaced one started from.
+func (cascade *Cascade) Tree() *CascadeTree {
+	source := cascade.source
+
+	placed := make(map[int64]bool, len(cascade.Hops))
+	var grow func(node *CascadeNode)
+	grow = func(node *CascadeNode) {
+		for _, hop := range cascade.Hops {
+			if placed[hop.PullRequestID] || source(hop) != node.Branch {
+				continue
+			}
+			placed[hop.PullRequestID] = true
+			child := &CascadeNode{Branch: hop.Destination, Hop: hop, Children: []*CascadeNode{}}
+			node.Children = append(node.Children, child)
+			grow(child)
+		}
+	}
+	root := &CascadeNode{Branch: cascade.Destination, Children: []*CascadeNode{}}
+	grow(root)
+
+	// Hops from branches outside the tree, e.g. recorded before their parent, stay visible
+	for _, hop := range cascade.Hops {
+		if !placed[hop.PullRequestID] {
+			root.Children = append(root.Children, &CascadeNode{Branch: hop.Destination, Hop: hop, Children: []*CascadeNode{}})
+		}
+	}
+	return &CascadeTree{Cascade: cascade, Tree: root}
+}
+
+/*** CASCADES -> TRACK EVERY HOP ***/
+/* =============================== */
+
+// startCascade records the cascade of origin, the first merge of a change starts it
+func (service *BitbucketService) startCascade(repository string, origin CascadeOrigin) {
+	if service.plan != nil || origin.CascadeID == "" {
+		return
+	}
+	now := time.Now()
+	cascade := &Cascade{
+		ID:            origin.CascadeID,
+		Repository:    repository,
+		PullRequestID: origin.PullRequestID,
+		Author:        ownerID(origin.Author),
+		StartedAt:     now,
+		UpdatedAt:     now,
+		MergedAt:      now,
+		Hops:          []*CascadeHop{},
+	}
+	if len(origin.Path) > 1 {
+		cascade.Source, cascade.Destination = origin.Path[0], origin.Path[1]
+	}
+	if pr := origin.PullRequest; pr != nil {
+		cascade.Title = pr.Title
+		cascade.Source = pr.Source.Branch.Name
+		cascade.Destination = pr.Destination.Branch.Name
+		//The webhook of the merge is usually handled right away, a retried one is not
+		if pr.State == "MERGED" && !pr.UpdatedOn.IsZero() {
+			cascade.MergedAt = pr.UpdatedOn
+		}
+	}
+	service.cascades.Start(cascade)
+}
+
+// recordHop adds a created cascade pull request to the cascade of origin
+func (service *BitbucketService) recordHop(origin CascadeOrigin, pr *PullRequest, replaces int64) {
+	if service.plan != nil || origin.CascadeID == "" || pr.ID <= 0 {
+		return
+	}
+	now := time.Now()
+	service.cascades.AddHop(origin.CascadeID, &CascadeHop{
+		PullRequestID: pr.ID,
+		Source:        pr.Source.Branch.Name,
+		Destination:   pr.Destination.Branch.Name,
+		State:         "OPEN",
+		CreatedAt:     now,
+		UpdatedAt:     now,
+		Replaces:      replaces,
+	})
+}
+
+// TrackPullRequest updates the state of a cascade pull request from a pull request webhook
+func (service *BitbucketService) TrackPullRequest(request *PullRequestMergedPayload) {
+	if request.PullRequest.ID <= 0 || request.PullRequest.State == "" {
+		return
+	}
+	at := request.PullRequest.UpdatedOn
+	if at.IsZero() {
+		at = time.Now()
+	}
+	service.updateHop(request.Repository.FullName, request.PullRequest.ID, request.PullRequest.State, at)
+
+	//A declined cascade is a human decision, the drift check must not reopen it
+	pr := &request.PullRequest
+	if pr.State == "DECLINED" && strings.HasPrefix(pr.Title, "#AutoCascade ") && service.plan == nil {
+		service.reconcile.PutDeclined(&DeclinedCascade{
+			Repository:    request.Repository.FullName,
+			PullRequestID: pr.ID,
+			Source:        pr.Source.Branch.Name,
+			Destination:   pr.Destination.Branch.Name,
+			CommitHash:    pr.Source.Commit.Hash,
+			DeclinedAt:    at,
+		})
+	}
+}
+
+// updateHop changes the state of a cascade pull request, counting its merge. It returns false when the
+// state didn't change or the pull request isn't tracked.
+func (service *BitbucketService) updateHop(repository string, pullRequestId int64, state string, at time.Time) bool {
+	cascade := service.cascades.UpdateHop(repository, pullRequestId, state, at)
+	if cascade == nil {
+		return false
+	}
+	if state != "MERGED" {
+		return true
+	}
+	settings := service.Registry.For(repository)
+	for _, hop := range cascade.Hops {
+		if hop.PullRequestID != pullRequestId {
+			continue
+		}
+		CascadePullRequests.Inc("merged", settings.stageName(hop.Destination))
+		//Only the change reaching the first release counts, not the release train after it
+		if !strings.HasPrefix(hop.Destination, settings.ReleaseBranchPrefix) ||
+			strings.HasPrefix(cascade.source(hop), settings.ReleaseBranchPrefix) {
+			continue
+		}
+		if service.cascades.Release(cascade.ID, at) {
+			mergedAt := cascade.MergedAt
+			if mergedAt.IsZero() {
+				//Cascades recorded before MergedAt existed
+				mergedAt = cascade.StartedAt
+			}
+			CascadeLeadTime.Observe(at.Sub(mergedAt).Seconds(), repository)
+		}
+	}
+	return true
+}
+
+// CascadeTree returns the cascade with its hops as a tree, nil when unknown
+func (service *BitbucketService) CascadeTree(id string) *CascadeTree {
+	cascade := service.cascades.Get(id)
+	if cascade == nil {
+		return nil
+	}
+	return cascade.Tree()
+}
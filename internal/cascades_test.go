@@ -0,0 +1,189 @@
+package internal
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// histogramValue returns the count and sum of a series, zero when it was never observed
+func histogramValue(vec *HistogramVec, labelValues ...string) (uint64, float64) {
+	vec.mu.Lock()
+	defer vec.mu.Unlock()
+	series, ok := vec.series[seriesKey(labelValues)]
+	if !ok {
+		return 0, 0
+	}
+	return series.count, series.sum
+}
+
+func TestLeadTimeFromTheOriginalMergeToTheFirstRelease(t *testing.T) {
+	service, _ := newTestService(t, nil)
+	repository := "workspace/lead-time"
+	mergedAt := time.Date(2026, 10, 1, 9, 0, 0, 0, time.UTC)
+
+	original := &PullRequest{ID: 100, Title: "Add the feature", State: "MERGED", UpdatedOn: mergedAt}
+	original.Source.Branch.Name = "feature/x"
+	original.Destination.Branch.Name = "develop"
+	origin := OriginOf(original, nil)
+	origin.CascadeID = CascadeID(repository, 100)
+	origin.PullRequest = original
+	// The cascade starts when the webhook is handled, the lead time at the merge
+	service.startCascade(repository, origin)
+
+	hop := func(id int64, source string, destination string) {
+		pr := &PullRequest{ID: id}
+		pr.Source.Branch.Name = source
+		pr.Destination.Branch.Name = destination
+		service.recordHop(origin, pr, 0)
+	}
+	hop(1, "develop", "dev/acme")
+	hop(2, "develop", "release/1.0")
+	hop(3, "release/1.0", "release/1.1")
+	hop(4, "develop", "release/2.0")
+	baseCount, baseSum := histogramValue(CascadeLeadTime, repository)
+
+	tests := []struct {
+		name    string
+		id      int64
+		at      time.Time
+		count   uint64
+		seconds float64
+	}{
+		{name: "stage branch", id: 1, at: mergedAt.Add(time.Hour)},
+		{name: "first release", id: 2, at: mergedAt.Add(2 * time.Hour), count: 1, seconds: 2 * 3600},
+		{name: "release train", id: 3, at: mergedAt.Add(3 * time.Hour), count: 1, seconds: 2 * 3600},
+		{name: "another release", id: 4, at: mergedAt.Add(4 * time.Hour), count: 1, seconds: 2 * 3600},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if !service.updateHop(repository, test.id, "MERGED", test.at) {
+				t.Fatalf("updateHop(%d) = false", test.id)
+			}
+			count, sum := histogramValue(CascadeLeadTime, repository)
+			if count-baseCount != test.count || sum-baseSum != test.seconds {
+				t.Errorf("lead time count = %d, sum = %v, want %d, %v", count-baseCount, sum-baseSum, test.count, test.seconds)
+			}
+		})
+	}
+}
+
+func TestLeadTimeSkipsTheReleaseTrainOnConflictBranches(t *testing.T) {
+	service, _ := newTestService(t, nil)
+	repository := "workspace/lead-time-train"
+
+	original := &PullRequest{ID: 100, Title: "Fix the release", State: "MERGED", UpdatedOn: time.Now().Add(-time.Hour)}
+	original.Source.Branch.Name = "bugfix/x"
+	original.Destination.Branch.Name = "release/1.0"
+	origin := OriginOf(original, nil)
+	origin.CascadeID = CascadeID(repository, 100)
+	origin.PullRequest = original
+	service.startCascade(repository, origin)
+
+	// The release train hop moved onto a conflict branch still comes from release/1.0
+	declined := &PullRequest{ID: 1}
+	declined.Source.Branch.Name = "release/1.0"
+	declined.Destination.Branch.Name = "release/1.1"
+	service.recordHop(origin, declined, 0)
+	resolution := &PullRequest{ID: 2}
+	resolution.Source.Branch.Name = ConflictBranchName("release/1.0", "release/1.1", "abc1234")
+	resolution.Destination.Branch.Name = "release/1.1"
+	service.recordHop(origin, resolution, 1)
+
+	baseCount, _ := histogramValue(CascadeLeadTime, repository)
+	if !service.updateHop(repository, 2, "MERGED", time.Now()) {
+		t.Fatal("updateHop(2) = false")
+	}
+	if count, _ := histogramValue(CascadeLeadTime, repository); count != baseCount {
+		t.Errorf("lead time observed %d times, want none", count-baseCount)
+	}
+}
+
+func TestCascadeStoreDropsTheOldestCascades(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cascades.json")
+	store, err := NewCascadeStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Filled directly, saving a thousand times is slow
+	start := time.Now().Add(-time.Hour)
+	for i := 0; i < maxCascades; i++ {
+		id := strconv.Itoa(i)
+		store.cascades[id] = &Cascade{ID: id, Repository: "workspace/repo", UpdatedAt: start.Add(time.Duration(i) * time.Second),
+			Hops: []*CascadeHop{{PullRequestID: int64(i + 1), State: "OPEN"}}}
+		store.hops[blockedKey("workspace/repo", int64(i+1))] = id
+	}
+	// The oldest cascade is still going, it is kept over the next ones
+	if store.UpdateHop("workspace/repo", 1, "MERGED", time.Now()) == nil {
+		t.Fatal("UpdateHop(1) = nil")
+	}
+
+	for i := 0; i < 2; i++ {
+		store.Start(&Cascade{ID: "new" + strconv.Itoa(i), Repository: "workspace/repo", UpdatedAt: time.Now()})
+	}
+
+	tests := []struct {
+		id   string
+		kept bool
+	}{
+		{id: "0", kept: true},
+		{id: "1"},
+		{id: "2"},
+		{id: "3", kept: true},
+		{id: "new0", kept: true},
+		{id: "new1", kept: true},
+	}
+	if store, err = NewCascadeStore(path); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(store.List()); got != maxCascades {
+		t.Errorf("%d cascades, want %d", got, maxCascades)
+	}
+	for _, test := range tests {
+		if got := store.Get(test.id) != nil; got != test.kept {
+			t.Errorf("cascade %s kept = %v, want %v", test.id, got, test.kept)
+		}
+	}
+	// The pull requests of the dropped cascades are forgotten with them
+	if store.UpdateHop("workspace/repo", 2, "MERGED", time.Now()) != nil {
+		t.Error("pull request of a dropped cascade still tracked")
+	}
+	if store.UpdateHop("workspace/repo", 4, "MERGED", time.Now()) == nil {
+		t.Error("pull request of a kept cascade not tracked")
+	}
+}
+
+func TestCascadeTree(t *testing.T) {
+	cascade := &Cascade{Destination: "develop", Hops: []*CascadeHop{
+		{PullRequestID: 1, Source: "develop", Destination: "dev/acme"},
+		{PullRequestID: 2, Source: "dev/acme", Destination: "qa/acme", State: "DECLINED"},
+		{PullRequestID: 3, Source: ConflictBranchName("dev/acme", "qa/acme", "abc1234"), Destination: "qa/acme", Replaces: 2},
+		{PullRequestID: 4, Source: "qa/acme", Destination: "uat/acme"},
+		{PullRequestID: 5, Source: "develop", Destination: "dev/globex"},
+		// Recorded without the hop into its source
+		{PullRequestID: 6, Source: "qa/globex", Destination: "uat/globex"},
+	}}
+
+	var render func(node *CascadeNode) string
+	render = func(node *CascadeNode) string {
+		var children []string
+		for _, child := range node.Children {
+			children = append(children, render(child))
+		}
+		label := node.Branch
+		if node.Hop != nil {
+			label = "#" + strconv.FormatInt(node.Hop.PullRequestID, 10) + " " + label
+		}
+		if len(children) == 0 {
+			return label
+		}
+		return label + " (" + strings.Join(children, ", ") + ")"
+	}
+
+	want := "develop (#1 dev/acme (#2 qa/acme (#4 uat/acme), #3 qa/acme), #5 dev/globex, #6 uat/globex)"
+	if got := render(cascade.Tree().Tree); got != want {
+		t.Errorf("Tree() = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,368 @@
+package internal
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BlockedCascade is a cascade pull request that can't merge because of merge conflicts, or a merge
+// strategy the branch doesn't allow
+type BlockedCascade struct {
+	Repository    string `json:"repository"`
+	PullRequestID int64  `json:"pull_request_id"`
+	Title         string `json:"title"`
+	Source        string `json:"source"`
+	Destination   string `json:"destination"`
+	// Author is the account ID of the author of the original change, when known
+	Author string   `json:"author,omitempty"`
+	Files  []string `json:"files"`
+	// Reason is why it can't merge when it isn't merge conflicts
+	Reason     string    `json:"reason,omitempty"`
+	DetectedAt time.Time `json:"detected_at"`
+}
+
+// BlockedStore keeps the blocked cascades until they merge or their conflicts are resolved. It is
+// saved to a file so the list survives restarts.
+type BlockedStore struct {
+	path string
+
+	mu       sync.Mutex
+	cascades map[string]*BlockedCascade
+}
+
+func NewBlockedStore(path string) (*BlockedStore, error) {
+	store := &BlockedStore{
+		path:     path,
+		cascades: make(map[string]*BlockedCascade),
+	}
+
+	buf, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(buf, &store.cascades); err != nil {
+			log.Println("BlockedStore -> ignoring unreadable file: ", path, err)
+			store.cascades = make(map[string]*BlockedCascade)
+		}
+	}
+	return store, nil
+}
+
+func (store *BlockedStore) Get(repository string, pullRequestId int64) *BlockedCascade {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	return store.cascades[blockedKey(repository, pullRequestId)]
+}
+
+func (store *BlockedStore) Put(cascade *BlockedCascade) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.cascades[blockedKey(cascade.Repository, cascade.PullRequestID)] = cascade
+	store.save()
+}
+
+func (store *BlockedStore) Remove(repository string, pullRequestId int64) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	key := blockedKey(repository, pullRequestId)
+	if _, ok := store.cascades[key]; ok {
+		delete(store.cascades, key)
+		store.save()
+	}
+}
+
+// List returns the blocked cascades, oldest first
+func (store *BlockedStore) List() []*BlockedCascade {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	cascades := make([]*BlockedCascade, 0, len(store.cascades))
+	for _, cascade := range store.cascades {
+		cascades = append(cascades, cascade)
+	}
+	sort.Slice(cascades, func(i, j int) bool {
+		return cascades[i].DetectedAt.Before(cascades[j].DetectedAt)
+	})
+	return cascades
+}
+
+// save is best effort, the reconciler finds the blocked cascades again after a restart
+func (store *BlockedStore) save() {
+	buf, err := json.Marshal(store.cascades)
+	if err == nil {
+		err = writeFileAtomic(store.path, buf)
+	}
+	if err != nil {
+		log.Println("BlockedStore -> could not save: ", err)
+	}
+}
+
+func blockedKey(repository string, pullRequestId int64) string {
+	return strings.ToLower(repository) + "#" + strconv.FormatInt(pullRequestId, 10)
+}
+
+// cascadeAuthor returns the account ID of the author of the original change of a cascade pull request,
+// empty for other pull requests or when the bot can't be looked up
+func (service *BitbucketService) cascadeAuthor(pr *PullRequest) string {
+	if !strings.HasPrefix(pr.Title, "#AutoCascade ") {
+		return ""
+	}
+	bot, err := service.currentUser()
+	if err != nil || !isCascadePullRequest(pr, bot) {
+		return ""
+	}
+	return authorFromDescription(pr.Description)
+}
+
+// isConflict reports whether a diffstat status is one of the conflict statuses
+func isConflict(status string) bool {
+	switch status {
+	case "added", "removed", "modified", "renamed":
+		return false
+	}
+	return true
+}
+
+// repositoryName returns the full name of the repository of a pull request
+func repositoryName(pr *PullRequest, repoOwner string, repoName string) string {
+	if pr.Destination.Repository.FullName != "" {
+		return pr.Destination.Repository.FullName
+	}
+	return repoOwner + "/" + repoName
+}
+
+// BlockedCascades returns the cascade pull requests waiting on merge conflicts
+func (service *BitbucketService) BlockedCascades() []*BlockedCascade {
+	return service.blocked.List()
+}
+
+/*** CONFLICTS -> NOTIFY AUTHOR ***/
+/* ============================== */
+
+// CheckConflicts looks for merge conflicts in the pull request. The first time some are found the
+// original author is tagged in a comment and the conflict marker added to the title, once they are
+// gone the marker is removed again.
+func (service *BitbucketService) CheckConflicts(settings *RepositorySettings, repoOwner string, repoName string, pr *PullRequest) (bool, error) {
+	log.Println("--------- START CheckConflicts ---------")
+
+	// Planned pull requests don't exist yet
+	if pr.ID <= 0 {
+		return false, nil
+	}
+
+	diffStats, err := service.bitbucketAPI.GetDiffStat(repoOwner, repoName, pr.ID)
+	if err != nil {
+		return false, err
+	}
+	var files []string
+	for _, diffStat := range diffStats {
+		if isConflict(diffStat.Status) {
+			files = append(files, diffStat.Path())
+		}
+	}
+
+	fullName := repositoryName(pr, repoOwner, repoName)
+	marked := settings.ConflictMarker != "" && strings.Contains(pr.Title, settings.ConflictMarker)
+
+	if len(files) == 0 {
+		if service.plan == nil {
+			service.blocked.Remove(fullName, pr.ID)
+		}
+		if marked {
+			title := strings.TrimSpace(strings.Replace(pr.Title, settings.ConflictMarker, "", 1))
+			if err := service.bitbucketAPI.UpdatePullRequest(repoOwner, repoName, pr.ID, PullRequestUpdate{Title: title}); err != nil {
+				return false, err
+			}
+		}
+		log.Println("--------- End CheckConflicts ---------")
+		return false, nil
+	}
+
+	log.Println("Conflicts in PR ", pr.ID, " -> ", files)
+	blocked := &BlockedCascade{
+		Repository:    fullName,
+		PullRequestID: pr.ID,
+		Title:         pr.Title,
+		Source:        pr.Source.Branch.Name,
+		Destination:   pr.Destination.Branch.Name,
+		Author:        service.cascadeAuthor(pr),
+		Files:         files,
+		DetectedAt:    time.Now(),
+	}
+	previous := service.blocked.Get(fullName, pr.ID)
+	if previous != nil {
+		blocked.DetectedAt = previous.DetectedAt
+	}
+
+	// Only notify once, the marker covers restarts
+	if previous == nil && !marked && settings.ConflictBranches && !strings.HasPrefix(pr.Source.Branch.Name, conflictBranchPrefix) {
+		//Not recorded on failure so the retry starts over
+		if err := service.openConflictBranch(settings, repoOwner, repoName, pr, blocked); err != nil {
+			return true, err
+		}
+		if service.plan == nil {
+			service.blocked.Put(blocked)
+		}
+		return true, nil
+	}
+	if previous == nil && !marked {
+		if err := service.bitbucketAPI.PostComment(repoOwner, repoName, pr.ID, conflictComment(blocked)); err != nil {
+			return true, err
+		}
+		if settings.ConflictMarker != "" {
+			blocked.Title = pr.Title + " " + settings.ConflictMarker
+			if err := service.bitbucketAPI.UpdatePullRequest(repoOwner, repoName, pr.ID, PullRequestUpdate{Title: blocked.Title}); err != nil {
+				return true, err
+			}
+		}
+	}
+	//A dry run only plans, the blocked list is what really happened
+	if service.plan == nil {
+		service.blocked.Put(blocked)
+	}
+
+	log.Println("--------- End CheckConflicts ---------")
+	return true, nil
+}
+
+const conflictBranchPrefix = "cascade/"
+
+// ConflictBranchName names the branch a conflicting cascade of src into dest is resolved on
+func ConflictBranchName(src string, dest string, commitHash string) string {
+	if len(commitHash) > 7 {
+		commitHash = commitHash[:7]
+	}
+	return conflictBranchPrefix + src + "-to-" + dest + "-" + commitHash
+}
+
+// openConflictBranch moves a conflicting cascade onto a branch created from the source commit, so the
+// author resolves the conflicts there instead of on a stage branch. Bitbucket can't change the source
+// of a pull request, so the cascade continues on a new pull request and the original is declined.
+// blocked is updated to the new pull request.
+func (service *BitbucketService) openConflictBranch(settings *RepositorySettings, repoOwner string, repoName string, pr *PullRequest, blocked *BlockedCascade) error {
+	log.Println("--------- START openConflictBranch ---------")
+
+	branch := ConflictBranchName(pr.Source.Branch.Name, pr.Destination.Branch.Name, pr.Source.Commit.Hash)
+	log.Println("Conflict branch -> ", branch)
+
+	//Retried jobs find the branch and pull request already there
+	branches, err := service.bitbucketAPI.ListBranches(repoOwner, repoName, []string{branch})
+	if err != nil {
+		return err
+	}
+	exists := false
+	for _, ref := range branches {
+		exists = exists || ref.Name == branch
+	}
+	if !exists {
+		if err := service.bitbucketAPI.CreateBranch(repoOwner, repoName, branch, pr.Source.Commit.Hash); err != nil {
+			return err
+		}
+	}
+
+	title := pr.Title
+	if settings.ConflictMarker != "" && !strings.Contains(title, settings.ConflictMarker) {
+		title += " " + settings.ConflictMarker
+	}
+	open, err := service.bitbucketAPI.ListPullRequests(repoOwner, repoName, PullRequestFilter{
+		State:             "OPEN",
+		SourceBranch:      branch,
+		DestinationBranch: pr.Destination.Branch.Name,
+	})
+	if err != nil {
+		return err
+	}
+	var resolution *PullRequest
+	if len(open) > 0 {
+		resolution = &open[0]
+	} else {
+		resolution, err = service.bitbucketAPI.CreatePullRequest(repoOwner, repoName, PullRequestOptions{
+			Title:             title,
+			Description:       pr.Description,
+			SourceBranch:      branch,
+			DestinationBranch: pr.Destination.Branch.Name,
+			CloseSourceBranch: true,
+		})
+		if err != nil {
+			return err
+		}
+		if service.plan == nil {
+			CascadePullRequests.Inc("created", settings.stageName(resolution.Destination.Branch.Name))
+		}
+		if err := service.bitbucketAPI.PostComment(repoOwner, repoName, resolution.ID, conflictBranchComment(blocked, branch, pr.Source.Commit.Hash)); err != nil {
+			return err
+		}
+	}
+
+	if err := service.bitbucketAPI.PostComment(repoOwner, repoName, pr.ID,
+		"Merge conflicts, this cascade continues on #"+strconv.FormatInt(resolution.ID, 10)+" from `"+branch+"`."); err != nil {
+		return err
+	}
+	if err := service.bitbucketAPI.DeclinePullRequest(repoOwner, repoName, pr.ID); err != nil {
+		return err
+	}
+	if service.plan == nil {
+		service.updateHop(blocked.Repository, pr.ID, "DECLINED", time.Now())
+		service.blocked.Remove(blocked.Repository, pr.ID)
+	}
+	//Failing to look up the bot only loses the hop on the cascade tree
+	if origin, err := service.originOf(pr); err != nil {
+		log.Println("originOf -> err: ", err)
+	} else {
+		service.recordHop(origin, resolution, pr.ID)
+	}
+
+	blocked.PullRequestID = resolution.ID
+	blocked.Title = title
+	blocked.Source = branch
+
+	log.Println("--------- End openConflictBranch ---------")
+	return nil
+}
+
+func conflictBranchComment(blocked *BlockedCascade, branch string, commitHash string) string {
+	var comment strings.Builder
+	if blocked.Author != "" {
+		comment.WriteString("@{" + blocked.Author + "} ")
+	}
+	comment.WriteString("the cascade of `" + blocked.Source + "` into `" + blocked.Destination + "` has merge conflicts in:\n\n")
+	for _, file := range blocked.Files {
+		comment.WriteString("* `" + file + "`\n")
+	}
+	comment.WriteString("\n`" + branch + "` was created from `" + blocked.Source + "` at " + commitHash +
+		" to resolve them without touching the stage branches:\n\n" +
+		"```\n" +
+		"git fetch origin\n" +
+		"git checkout " + branch + "\n" +
+		"git merge origin/" + blocked.Destination + "\n" +
+		"# resolve the conflicts and commit\n" +
+		"git push origin " + branch + "\n" +
+		"```\n\n" +
+		"This pull request is merged automatically once the builds pass, and the cascade continues from `" + blocked.Destination + "`.")
+	return comment.String()
+}
+
+func conflictComment(blocked *BlockedCascade) string {
+	var comment strings.Builder
+	if blocked.Author != "" {
+		comment.WriteString("@{" + blocked.Author + "} ")
+	}
+	comment.WriteString("this cascade of `" + blocked.Source + "` into `" + blocked.Destination +
+		"` has merge conflicts and will not be merged automatically:\n\n")
+	for _, file := range blocked.Files {
+		comment.WriteString("* `" + file + "`\n")
+	}
+	comment.WriteString("\nPlease resolve the conflicts, the cascade continues once this pull request merges.")
+	return comment.String()
+}
@@ -0,0 +1,214 @@
+package internal
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// createCascade opens a cascade pull request of alice's change from dev/acme into qa/acme
+func createCascade(t *testing.T, fake *FakeBitbucket) *PullRequest {
+	t.Helper()
+	fake.AddCommit(testOwner, testSlug, "dev/acme", "feature1", "Add the feature")
+	pr, err := fake.CreatePullRequest(testOwner, testSlug, PullRequestOptions{
+		Title:             "#AutoCascade Add the feature",
+		Description:       "Cascade of #1\n\n" + originLines,
+		SourceBranch:      "dev/acme",
+		DestinationBranch: "qa/acme",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pr
+}
+
+func TestBlockedStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocked.json")
+	store, err := NewBlockedStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	store.Put(&BlockedCascade{Repository: "Workspace/Repo", PullRequestID: 2, DetectedAt: now})
+	store.Put(&BlockedCascade{Repository: "workspace/repo", PullRequestID: 1, DetectedAt: now.Add(-time.Hour)})
+	store.Put(&BlockedCascade{Repository: "workspace/other", PullRequestID: 1, DetectedAt: now.Add(-time.Minute)})
+	store.Remove("workspace/other", 1)
+	store.Remove("workspace/other", 99)
+
+	// The list survives restarts, oldest first
+	if store, err = NewBlockedStore(path); err != nil {
+		t.Fatal(err)
+	}
+	var listed []int64
+	for _, blocked := range store.List() {
+		listed = append(listed, blocked.PullRequestID)
+	}
+	if len(listed) != 2 || listed[0] != 1 || listed[1] != 2 {
+		t.Errorf("List() = %v, want #1 then #2", listed)
+	}
+	// Repository names are case insensitive
+	if store.Get("WORKSPACE/REPO", 2) == nil {
+		t.Error("Get(WORKSPACE/REPO, 2) = nil")
+	}
+	if store.Get("workspace/other", 1) != nil {
+		t.Error("removed cascade still blocked")
+	}
+
+	if err := ioutil.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if store, err = NewBlockedStore(path); err != nil || len(store.List()) != 0 {
+		t.Errorf("unreadable file = %v, %v, want an empty store", store, err)
+	}
+}
+
+func TestCheckConflicts(t *testing.T) {
+	service, fake := newTestService(t, nil)
+	settings := *service.Registry.For(testOwner + "/" + testSlug)
+	settings.ConflictBranches = false
+	pr := createCascade(t, fake)
+	fullName := testOwner + "/" + testSlug
+
+	tests := []struct {
+		name      string
+		conflicts []string
+		blocked   bool
+		comments  int
+		title     string
+	}{
+		{name: "no conflicts", title: "#AutoCascade Add the feature"},
+		{name: "conflicts", conflicts: []string{"go.mod", "main.go"}, blocked: true, comments: 1, title: "#AutoCascade Add the feature [CONFLICT]"},
+		{name: "still conflicting", conflicts: []string{"go.mod"}, blocked: true, comments: 1, title: "#AutoCascade Add the feature [CONFLICT]"},
+		{name: "resolved", comments: 1, title: "#AutoCascade Add the feature"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake.SetConflicts(testOwner, testSlug, pr.ID, test.conflicts...)
+			current, err := fake.GetPullRequest(testOwner, testSlug, pr.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			blocked, err := service.CheckConflicts(&settings, testOwner, testSlug, current)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if blocked != test.blocked {
+				t.Errorf("CheckConflicts() = %v, want %v", blocked, test.blocked)
+			}
+			if current, _ = fake.GetPullRequest(testOwner, testSlug, pr.ID); current.Title != test.title {
+				t.Errorf("title = %q, want %q", current.Title, test.title)
+			}
+			comments := fake.Comments(testOwner, testSlug, pr.ID)
+			if len(comments) != test.comments {
+				t.Fatalf("comments = %q, want %d", comments, test.comments)
+			}
+			if len(comments) > 0 && (!strings.HasPrefix(comments[0], "@{alice} ") || !strings.Contains(comments[0], "* `main.go`")) {
+				t.Errorf("comment = %q, want alice tagged with the files", comments[0])
+			}
+
+			stored := service.blocked.Get(fullName, pr.ID)
+			if (stored != nil) != test.blocked {
+				t.Fatalf("blocked cascade = %+v, want blocked %v", stored, test.blocked)
+			}
+			if stored != nil && (stored.Author != "alice" || strings.Join(stored.Files, ",") != strings.Join(test.conflicts, ",")) {
+				t.Errorf("blocked cascade = %+v", stored)
+			}
+		})
+	}
+}
+
+func TestCheckConflictsOnlyTrustsTheBot(t *testing.T) {
+	service, fake := newTestService(t, nil)
+	settings := *service.Registry.For(testOwner + "/" + testSlug)
+	settings.ConflictBranches = false
+	// A human copying the cascade lines can't get someone else tagged
+	fake.SetCurrentUser(Owner{UUID: "{someone-else}", AccountId: "someone-else"})
+	pr := createCascade(t, fake)
+	fake.SetCurrentUser(*testBot)
+	fake.SetConflicts(testOwner, testSlug, pr.ID, "go.mod")
+
+	if _, err := service.CheckConflicts(&settings, testOwner, testSlug, pr); err != nil {
+		t.Fatal(err)
+	}
+	comments := fake.Comments(testOwner, testSlug, pr.ID)
+	if len(comments) != 1 || strings.HasPrefix(comments[0], "@") {
+		t.Errorf("comments = %q, want one tagging nobody", comments)
+	}
+}
+
+func TestOpenConflictBranch(t *testing.T) {
+	tests := []struct {
+		name string
+		// branchExists is a conflict branch left by a failed attempt
+		branchExists bool
+	}{
+		{name: "first attempt"},
+		{name: "retried attempt", branchExists: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			service, fake := newTestService(t, nil)
+			settings := service.Registry.For(testOwner + "/" + testSlug)
+			pr := createCascade(t, fake)
+			branch := ConflictBranchName("dev/acme", "qa/acme", pr.Source.Commit.Hash)
+			if test.branchExists {
+				if err := fake.CreateBranch(testOwner, testSlug, branch, pr.Source.Commit.Hash); err != nil {
+					t.Fatal(err)
+				}
+			}
+			fake.SetConflicts(testOwner, testSlug, pr.ID, "go.mod")
+
+			blocked, err := service.CheckConflicts(settings, testOwner, testSlug, pr)
+			if err != nil || !blocked {
+				t.Fatalf("CheckConflicts() = %v, %v", blocked, err)
+			}
+
+			original, _ := fake.GetPullRequest(testOwner, testSlug, pr.ID)
+			if original.State != "DECLINED" {
+				t.Errorf("original pull request is %s, want DECLINED", original.State)
+			}
+			comments := fake.Comments(testOwner, testSlug, pr.ID)
+			if len(comments) != 1 || !strings.Contains(comments[0], "continues on #2 from `"+branch+"`") {
+				t.Errorf("comments on the original = %q", comments)
+			}
+
+			resolution, ok := openCascades(fake)["qa/acme"]
+			if !ok || resolution.Source.Branch.Name != branch || !resolution.CloseSourceBranch {
+				t.Fatalf("resolution pull request = %+v, want one from %s", resolution, branch)
+			}
+			if resolution.Title != "#AutoCascade Add the feature [CONFLICT]" || resolution.Description != original.Description {
+				t.Errorf("resolution pull request = %q, %q", resolution.Title, resolution.Description)
+			}
+			comments = fake.Comments(testOwner, testSlug, resolution.ID)
+			if len(comments) != 1 || !strings.HasPrefix(comments[0], "@{alice} ") || !strings.Contains(comments[0], "git checkout "+branch) {
+				t.Errorf("comments on the resolution = %q", comments)
+			}
+
+			// The blocked list follows the cascade onto the resolution pull request
+			if service.blocked.Get(testOwner+"/"+testSlug, pr.ID) != nil {
+				t.Error("declined pull request still blocked")
+			}
+			if stored := service.blocked.Get(testOwner+"/"+testSlug, resolution.ID); stored == nil || stored.Source != branch {
+				t.Errorf("blocked resolution = %+v", stored)
+			}
+		})
+	}
+}
+
+func TestConflictBranchName(t *testing.T) {
+	tests := []struct {
+		src, dest, hash string
+		want            string
+	}{
+		{"dev/acme", "qa/acme", "0123456789abcdef", "cascade/dev/acme-to-qa/acme-0123456"},
+		{"develop", "release/1.0", "abc", "cascade/develop-to-release/1.0-abc"},
+	}
+	for _, test := range tests {
+		if got := ConflictBranchName(test.src, test.dest, test.hash); got != test.want {
+			t.Errorf("ConflictBranchName(%q, %q, %q) = %q, want %q", test.src, test.dest, test.hash, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxDashboardCascades is the number of recent cascades shown per repository
+const maxDashboardCascades = 20
+
+// maxDashboardFailures is the number of recent webhook failures shown
+const maxDashboardFailures = 50
+
+// DashboardFilter narrows the dashboard to a repository, a site and a stage, empty matches all
+type DashboardFilter struct {
+	Repository string
+	Site       string
+	Stage      string
+}
+
+// DashboardHop is a cascade pull request with the stage and site of its destination
+type DashboardHop struct {
+	*CascadeHop
+	Repository string
+	CascadeID  string
+	Stage      string
+	Site       string
+}
+
+// DashboardCascade is a cascade with the hops matching the filter
+type DashboardCascade struct {
+	*Cascade
+	Hops []DashboardHop
+}
+
+// DashboardRepository is the recent cascades of a repository
+type DashboardRepository struct {
+	Name     string
+	Cascades []DashboardCascade
+}
+
+// WebhookFailure is a webhook delivery that failed, given up on or waiting to be retried
+type WebhookFailure struct {
+	ID         string
+	EventKey   string
+	Repository string
+	Attempts   int
+	CreatedAt  time.Time
+	LastError  string
+	Retrying   bool
+}
+
+// Dashboard is what the status page shows
+type Dashboard struct {
+	Filter       DashboardFilter
+	Repositories []string
+	Cascades     []DashboardRepository
+	Blocked      []*BlockedCascade
+	Waiting      []DashboardHop
+	Failures     []WebhookFailure
+	GeneratedAt  time.Time
+}
+
+// WebhookFailures turns failed jobs into webhook failures, reading the repository from their payload
+func WebhookFailures(jobs []*Job) []WebhookFailure {
+	failures := make([]WebhookFailure, 0, len(jobs))
+	for _, job := range jobs {
+		var payload struct {
+			Repository struct {
+				FullName string `json:"full_name"`
+			} `json:"repository"`
+		}
+		//Unreadable payloads are failures too, just without a repository
+		_ = json.Unmarshal(job.Payload, &payload)
+		failures = append(failures, WebhookFailure{
+			ID:         job.ID,
+			EventKey:   job.EventKey,
+			Repository: payload.Repository.FullName,
+			Attempts:   job.Attempts,
+			CreatedAt:  job.CreatedAt,
+			LastError:  job.LastError,
+			Retrying:   job.FailedAt.IsZero(),
+		})
+	}
+	return failures
+}
+
+/*** DASHBOARD -> CASCADE STATUS PAGE ***/
+/* ==================================== */
+
+// Dashboard gathers the recent cascades, blocked and waiting pull requests and webhook failures
+// matching the filter
+func (service *BitbucketService) Dashboard(filter DashboardFilter, failures []WebhookFailure) *Dashboard {
+	dashboard := &Dashboard{Filter: filter, GeneratedAt: time.Now()}
+
+	repositories := make(map[string]bool)
+	for _, repository := range service.KnownRepositories() {
+		repositories[repository.FullName] = true
+	}
+
+	byRepository := make(map[string]*DashboardRepository)
+	for _, cascade := range service.cascades.List() {
+		repositories[cascade.Repository] = true
+		if !filter.matchesRepository(cascade.Repository) {
+			continue
+		}
+		settings := service.Registry.For(cascade.Repository)
+
+		shown := DashboardCascade{Cascade: cascade}
+		for _, hop := range cascade.Hops {
+			dashboardHop := newDashboardHop(settings, cascade, hop)
+			if !filter.matchesHop(dashboardHop) {
+				continue
+			}
+			shown.Hops = append(shown.Hops, dashboardHop)
+			if hop.State == "OPEN" && hop.WaitingForBuilds {
+				dashboard.Waiting = append(dashboard.Waiting, dashboardHop)
+			}
+		}
+		//A cascade without hops yet is shown when its own branch matches
+		if len(shown.Hops) == 0 && !filter.matchesBranch(settings, cascade.Destination) {
+			continue
+		}
+
+		group, ok := byRepository[cascade.Repository]
+		if !ok {
+			group = &DashboardRepository{Name: cascade.Repository}
+			byRepository[cascade.Repository] = group
+		}
+		if len(group.Cascades) < maxDashboardCascades {
+			group.Cascades = append(group.Cascades, shown)
+		}
+	}
+	for _, group := range byRepository {
+		dashboard.Cascades = append(dashboard.Cascades, *group)
+	}
+	sort.Slice(dashboard.Cascades, func(i, j int) bool {
+		return dashboard.Cascades[i].Name < dashboard.Cascades[j].Name
+	})
+
+	for _, blocked := range service.BlockedCascades() {
+		repositories[blocked.Repository] = true
+		if filter.matchesRepository(blocked.Repository) && filter.matchesBranch(service.Registry.For(blocked.Repository), blocked.Destination) {
+			dashboard.Blocked = append(dashboard.Blocked, blocked)
+		}
+	}
+
+	//Failures have no branch to filter on
+	for _, failure := range failures {
+		if filter.matchesRepository(failure.Repository) {
+			dashboard.Failures = append(dashboard.Failures, failure)
+		}
+	}
+
+	for repository := range repositories {
+		dashboard.Repositories = append(dashboard.Repositories, repository)
+	}
+	sort.Strings(dashboard.Repositories)
+	return dashboard
+}
+
+func newDashboardHop(settings *RepositorySettings, cascade *Cascade, hop *CascadeHop) DashboardHop {
+	branch := settings.ParseBranch(hop.Destination)
+	dashboardHop := DashboardHop{CascadeHop: hop, Repository: cascade.Repository, CascadeID: cascade.ID, Site: branch.Site}
+	if branch.Stage != nil {
+		dashboardHop.Stage = branch.Stage.Name
+	}
+	return dashboardHop
+}
+
+func (filter DashboardFilter) matchesRepository(repository string) bool {
+	return filter.Repository == "" || strings.EqualFold(filter.Repository, repository)
+}
+
+func (filter DashboardFilter) matchesHop(hop DashboardHop) bool {
+	return (filter.Site == "" || strings.EqualFold(filter.Site, hop.Site)) &&
+		(filter.Stage == "" || strings.EqualFold(filter.Stage, hop.Stage))
+}
+
+func (filter DashboardFilter) matchesBranch(settings *RepositorySettings, name string) bool {
+	if filter.Site == "" && filter.Stage == "" {
+		return true
+	}
+	branch := settings.ParseBranch(name)
+	hop := DashboardHop{Site: branch.Site}
+	if branch.Stage != nil {
+		hop.Stage = branch.Stage.Name
+	}
+	return filter.matchesHop(hop)
+}
+
+// pullRequestURL links to a pull request on bitbucket.org
+func pullRequestURL(repository string, pullRequestId int64) string {
+	return fmt.Sprintf("https://bitbucket.org/%s/pull-requests/%d", repository, pullRequestId)
+}
+
+// DashboardTemplate renders the Dashboard, it refreshes every minute
+var DashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"pullRequestURL": pullRequestURL,
+	"time": func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format("2006-01-02 15:04:05")
+	},
+	"lower": strings.ToLower,
+}).Parse(dashboardHTML))
+
+const dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="60">
+<title>Cascade merge</title>
+<style>
+body { font-family: sans-serif; margin: 1em 2em; color: #172b4d; }
+table { border-collapse: collapse; margin-bottom: 1.5em; width: 100%; }
+th, td { border-bottom: 1px solid #dfe1e6; padding: 4px 8px; text-align: left; vertical-align: top; }
+th { background: #f4f5f7; }
+.state { font-size: 0.85em; font-weight: bold; padding: 1px 6px; border-radius: 3px; white-space: nowrap; }
+.open { background: #deebff; } .merged { background: #e3fcef; } .declined { background: #ffebe6; } .waiting { background: #fffae6; }
+.muted { color: #6b778c; }
+pre { margin: 0; white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<h1>Cascade merge</h1>
+<form method="get">
+<label>Repository <select name="repository">
+<option value="">All</option>
+{{- range .Repositories}}
+<option value="{{.}}"{{if eq . $.Filter.Repository}} selected{{end}}>{{.}}</option>
+{{- end}}
+</select></label>
+<label>Site <input name="site" value="{{.Filter.Site}}"></label>
+<label>Stage <input name="stage" value="{{.Filter.Stage}}"></label>
+<button type="submit">Filter</button>
+</form>
+
+<h2>Blocked</h2>
+{{- if .Blocked}}
+<table>
+<tr><th>Repository</th><th>Pull request</th><th>Branches</th><th>Author</th><th>Files or reason</th><th>Since</th></tr>
+{{- range .Blocked}}
+<tr><td>{{.Repository}}</td><td><a href="{{pullRequestURL .Repository .PullRequestID}}">#{{.PullRequestID}}</a> {{.Title}}</td>
+<td>{{.Source}} &rarr; {{.Destination}}</td><td>{{.Author}}</td><td>{{range .Files}}{{.}}<br>{{end}}{{.Reason}}</td><td>{{time .DetectedAt}}</td></tr>
+{{- end}}
+</table>
+{{- else}}
+<p class="muted">None</p>
+{{- end}}
+
+<h2>Waiting for builds</h2>
+{{- if .Waiting}}
+<table>
+<tr><th>Repository</th><th>Pull request</th><th>Branches</th><th>Stage</th><th>Site</th><th>Cascade</th><th>Since</th></tr>
+{{- range .Waiting}}
+<tr><td>{{.Repository}}</td><td><a href="{{pullRequestURL .Repository .PullRequestID}}">#{{.PullRequestID}}</a></td>
+<td>{{.Source}} &rarr; {{.Destination}}</td><td>{{.Stage}}</td><td>{{.Site}}</td>
+<td><a href="cascades/{{.CascadeID}}">{{.CascadeID}}</a></td><td>{{time .UpdatedAt}}</td></tr>
+{{- end}}
+</table>
+{{- else}}
+<p class="muted">None</p>
+{{- end}}
+
+<h2>Recent cascades</h2>
+{{- range .Cascades}}
+<h3>{{.Name}}</h3>
+<table>
+<tr><th>Cascade</th><th>Original pull request</th><th>Pull requests</th><th>Updated</th></tr>
+{{- range .Cascades}}
+<tr><td><a href="cascades/{{.ID}}">{{.ID}}</a></td>
+<td><a href="{{pullRequestURL .Repository .PullRequestID}}">#{{.PullRequestID}}</a> {{.Title}}<br>
+<span class="muted">{{.Source}} &rarr; {{.Destination}}{{if .Author}} by {{.Author}}{{end}}</span></td>
+<td>{{- $cascade := .}}
+{{- range .Hops}}
+<a href="{{pullRequestURL $cascade.Repository .PullRequestID}}">#{{.PullRequestID}}</a> {{.Source}} &rarr; {{.Destination}}
+<span class="state {{lower .State}}">{{.State}}</span>{{if and .WaitingForBuilds (eq .State "OPEN")}} <span class="state waiting">BUILDING</span>{{end}}<br>
+{{- else}}
+<span class="muted">No cascade pull requests</span>
+{{- end}}
+</td><td>{{time .UpdatedAt}}</td></tr>
+{{- end}}
+</table>
+{{- else}}
+<p class="muted">None</p>
+{{- end}}
+
+<h2>Webhook failures</h2>
+{{- if .Failures}}
+<table>
+<tr><th>Received</th><th>Event</th><th>Repository</th><th>Attempts</th><th>Error</th></tr>
+{{- range .Failures}}
+<tr><td>{{time .CreatedAt}}</td><td>{{.EventKey}}</td><td>{{.Repository}}</td>
+<td>{{.Attempts}}{{if .Retrying}} <span class="state waiting">RETRYING</span>{{else}} <span class="state declined">GAVE UP</span>{{end}}</td>
+<td><pre>{{.LastError}}</pre></td></tr>
+{{- end}}
+</table>
+{{- else}}
+<p class="muted">None</p>
+{{- end}}
+
+<p class="muted">Generated {{time .GeneratedAt}}</p>
+</body>
+</html>
+`
@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// DeliveryStore remembers the webhook deliveries already accepted for a time window, so
+// Bitbucket retries and manual redeliveries are not processed twice. It is saved to a file
+// so the window survives restarts.
+type DeliveryStore struct {
+	path string
+	ttl  time.Duration
+
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+func NewDeliveryStore(path string, ttl time.Duration) (*DeliveryStore, error) {
+	store := &DeliveryStore{
+		path: path,
+		ttl:  ttl,
+		seen: make(map[string]time.Time),
+	}
+
+	buf, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(buf, &store.seen); err != nil {
+			log.Println("DeliveryStore -> ignoring unreadable file: ", path, err)
+			store.seen = make(map[string]time.Time)
+		}
+	}
+	store.prune(time.Now())
+	return store, nil
+}
+
+// MarkIfNew records the delivery and reports true, or reports false when it was already seen within the window
+func (store *DeliveryStore) MarkIfNew(id string) bool {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	now := time.Now()
+	if at, ok := store.seen[id]; ok && now.Sub(at) < store.ttl {
+		DuplicateDeliveries.Inc()
+		return false
+	}
+	store.prune(now)
+	store.seen[id] = now
+	store.save()
+	return true
+}
+
+// Forget drops a delivery, e.g. when it could not be queued and Bitbucket should be allowed to retry it
+func (store *DeliveryStore) Forget(id string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	delete(store.seen, id)
+	store.save()
+}
+
+func (store *DeliveryStore) prune(now time.Time) {
+	for id, at := range store.seen {
+		if now.Sub(at) >= store.ttl {
+			delete(store.seen, id)
+		}
+	}
+}
+
+// save is best effort, losing it only shortens the window after a restart
+func (store *DeliveryStore) save() {
+	buf, err := json.Marshal(store.seen)
+	if err == nil {
+		err = writeFileAtomic(store.path, buf)
+	}
+	if err != nil {
+		log.Println("DeliveryStore -> could not save: ", err)
+	}
+}
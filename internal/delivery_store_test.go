@@ -0,0 +1,73 @@
+package internal
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDeliveryStore(t *testing.T) {
+	tests := []struct {
+		name string
+		// age is how long ago the delivery was first seen, negative when it wasn't
+		age     time.Duration
+		forget  bool
+		restart bool
+		want    bool
+	}{
+		{name: "new delivery", age: -1, want: true},
+		{name: "redelivered", age: time.Minute, want: false},
+		{name: "redelivered after a restart", age: time.Minute, restart: true, want: false},
+		{name: "redelivered after the window", age: time.Hour, want: true},
+		{name: "expired before a restart", age: time.Hour, restart: true, want: true},
+		{name: "forgotten", age: time.Minute, forget: true, want: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "deliveries.json")
+			store, err := NewDeliveryStore(path, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.age >= 0 {
+				store.MarkIfNew("delivery")
+				store.seen["delivery"] = time.Now().Add(-test.age)
+				store.save()
+			}
+			if test.forget {
+				store.Forget("delivery")
+			}
+			if test.restart {
+				if store, err = NewDeliveryStore(path, time.Hour); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			duplicates := counterValue(DuplicateDeliveries)
+			if got := store.MarkIfNew("delivery"); got != test.want {
+				t.Errorf("MarkIfNew() = %v, want %v", got, test.want)
+			}
+			if counted := counterValue(DuplicateDeliveries) - duplicates; (counted == 1) == test.want {
+				t.Errorf("counted %v duplicates", counted)
+			}
+			// Whatever happened before, the delivery is now in the window
+			if store.MarkIfNew("delivery") {
+				t.Error("second MarkIfNew() = true")
+			}
+		})
+	}
+}
+
+func TestDeliveryStorePrunesExpiredDeliveries(t *testing.T) {
+	store, err := NewDeliveryStore(filepath.Join(t.TempDir(), "deliveries.json"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.MarkIfNew("old")
+	store.seen["old"] = time.Now().Add(-2 * time.Hour)
+
+	store.MarkIfNew("new")
+	if _, ok := store.seen["old"]; ok || len(store.seen) != 1 {
+		t.Errorf("seen = %v, want only the new delivery", store.seen)
+	}
+}
@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"text/template"
+)
+
+// DefaultDescriptionTemplate is the description of cascade pull requests unless the repository
+// configures description_template
+const DefaultDescriptionTemplate = `#AutoCascade {{.Source}} -> {{.Destination}}, this branch will automatically be merged on successful build result+approval
+{{- with .Origin}}
+
+Cascade of {{if .Links.HTML.Href}}[#{{.ID}} {{.Title}}]({{.Links.HTML.Href}}){{else}}#{{.ID}} {{.Title}}{{end}}
+{{- with .Author.DisplayName}} by {{.}}{{end}}
+{{- with .MergeCommit.Hash}}, merged as {{short .}}{{end}}
+{{- end}}
+
+Cascade path: {{join .Path " -> "}}
+{{- if .Commits}}
+
+Commits:
+{{- range .Commits}}
+* {{short .Hash}} {{firstLine .Message}}
+{{- end}}
+{{- if .MoreCommits}}
+* and {{.MoreCommits}} more
+{{- end}}
+{{- end}}
+{{- if .NextHops}}
+
+Next: {{join .NextHops ", "}}
+{{- end}}
+`
+
+// DescriptionData is what description templates are executed with
+type DescriptionData struct {
+	Source      string
+	Destination string
+	// Origin is the pull request the cascade started from, nil for missed cascades or when it can't be read
+	Origin *PullRequest
+	// Path is the branches the change went through, ending with Destination
+	Path []string
+	// Commits are the newest commits carried by the pull request, MoreCommits counts the others
+	Commits     []Commit
+	MoreCommits int
+	// NextHops are the branches a merge into Destination cascades into
+	NextHops []string
+}
+
+const maxDescriptionCommits = 20
+
+var descriptionFuncs = template.FuncMap{
+	"join": strings.Join,
+	"short": func(hash string) string {
+		if len(hash) > 7 {
+			return hash[:7]
+		}
+		return hash
+	},
+	"firstLine": func(message string) string {
+		return strings.TrimSpace(strings.SplitN(message, "\n", 2)[0])
+	},
+}
+
+// NewDescriptionTemplate parses a description template, with the join, short and firstLine functions
+func NewDescriptionTemplate(text string) (*template.Template, error) {
+	return template.New("description").Funcs(descriptionFuncs).Parse(text)
+}
+
+// Describe renders the description of a cascade pull request from src into dest. Failing reads only
+// leave the matching data out, a failing template falls back on the plain description.
+func (service *BitbucketService) Describe(settings *RepositorySettings, repoOwner string, repoName string, src string, dest string, origin CascadeOrigin) string {
+	log.Println("--------- START Describe ---------")
+
+	data := DescriptionData{
+		Source:      src,
+		Destination: dest,
+		Origin:      origin.PullRequest,
+		Path:        origin.Path,
+	}
+
+	commits, err := service.bitbucketAPI.ListCommits(repoOwner, repoName, src, dest)
+	if err != nil {
+		log.Println("ListCommits -> err: ", err)
+	}
+	if len(commits) > maxDescriptionCommits {
+		data.MoreCommits = len(commits) - maxDescriptionCommits
+		commits = commits[:maxDescriptionCommits]
+	}
+	data.Commits = commits
+
+	if targets, err := service.GetBranches(settings, repoName, repoOwner); err != nil {
+		log.Println("GetBranches -> err: ", err)
+	} else {
+		data.NextHops = service.NextTargets(settings, settings.ParseBranch(dest), targets)
+	}
+
+	var description bytes.Buffer
+	if err := settings.Description.Execute(&description, data); err != nil {
+		log.Println("Description template -> err: ", err)
+		return "#AutoCascade " + src + " -> " + dest + ", this branch will automatically be merged on " +
+			"successful build result+approval"
+	}
+
+	log.Println("--------- End Describe ---------")
+	return strings.TrimSpace(description.String())
+}
@@ -0,0 +1,84 @@
+package internal
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// testOrigin is alice's pull request #100, merged into develop
+func testOrigin() CascadeOrigin {
+	pr := &PullRequest{ID: 100, Title: "Add the feature", Author: Owner{AccountId: "alice", DisplayName: "Alice"}}
+	pr.Links.HTML.Href = "https://bitbucket.org/workspace/repo/pull-requests/100"
+	pr.MergeCommit.Hash = "0123456789abcdef"
+	return CascadeOrigin{PullRequestID: 100, PullRequest: pr, Path: []string{"feature/x", "develop", "dev/acme"}}
+}
+
+func TestDescribe(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		origin   CascadeOrigin
+		commits  int
+		want     string
+	}{
+		{
+			name:   "default template",
+			origin: testOrigin(),
+			want: "#AutoCascade develop -> dev/acme, this branch will automatically be merged on successful build result+approval\n\n" +
+				"Cascade of [#100 Add the feature](https://bitbucket.org/workspace/repo/pull-requests/100) by Alice, merged as 0123456\n\n" +
+				"Cascade path: feature/x -> develop -> dev/acme\n\n" +
+				"Commits:\n" +
+				"* feature Add the feature\n\n" +
+				"Next: qa/acme",
+		},
+		{
+			name:   "without the original pull request",
+			origin: CascadeOrigin{Path: []string{"develop", "dev/acme"}},
+			want: "#AutoCascade develop -> dev/acme, this branch will automatically be merged on successful build result+approval\n\n" +
+				"Cascade path: develop -> dev/acme\n\n" +
+				"Commits:\n" +
+				"* feature Add the feature\n\n" +
+				"Next: qa/acme",
+		},
+		{
+			name:     "repository template",
+			template: "{{.Source}} into {{.Destination}}{{range .Commits}} {{short .Hash}}{{end}}{{with .MoreCommits}} +{{.}}{{end}}",
+			origin:   testOrigin(),
+			commits:  maxDescriptionCommits + 1,
+			want:     "develop into dev/acme c21 c20 c19 c18 c17 c16 c15 c14 c13 c12 c11 c10 c9 c8 c7 c6 c5 c4 c3 c2 +2",
+		},
+		{
+			name:     "failing template",
+			template: "by {{.Origin.Author.DisplayName}}",
+			want:     "#AutoCascade develop -> dev/acme, this branch will automatically be merged on successful build result+approval",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			service, fake := newTestService(t, nil)
+			settings := *service.Registry.For(testOwner + "/" + testSlug)
+			if test.template != "" {
+				description, err := NewDescriptionTemplate(test.template)
+				if err != nil {
+					t.Fatal(err)
+				}
+				settings.Description = description
+			}
+			for i := 1; i <= test.commits; i++ {
+				fake.AddCommit(testOwner, testSlug, "develop", "c"+strconv.Itoa(i), "Commit "+strconv.Itoa(i))
+			}
+
+			got := service.Describe(&settings, testOwner, testSlug, "develop", "dev/acme", test.origin)
+			if got != test.want {
+				t.Errorf("Describe() =\n%s\nwant\n%s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestNewDescriptionTemplateRejectsInvalidTemplates(t *testing.T) {
+	if _, err := NewDescriptionTemplate("{{.Source"); err == nil || !strings.Contains(err.Error(), "description") {
+		t.Errorf("NewDescriptionTemplate() = %v, want a parse error", err)
+	}
+}
@@ -0,0 +1,210 @@
+package internal
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// PlannedAction is a mutating Bitbucket call a dry run skipped
+type PlannedAction struct {
+	// Action is one of create, approve, merge, comment, update, decline or branch
+	Action     string `json:"action"`
+	Repository string `json:"repository"`
+	// PullRequestID is negative for pull requests the plan would create
+	PullRequestID int64    `json:"pull_request_id"`
+	Source        string   `json:"source,omitempty"`
+	Destination   string   `json:"destination,omitempty"`
+	Title         string   `json:"title,omitempty"`
+	MergeStrategy string   `json:"merge_strategy,omitempty"`
+	Reviewers     []string `json:"reviewers,omitempty"`
+}
+
+// CascadePlan is everything a merge into Branch would trigger, following the planned auto merges
+// down the pipeline
+type CascadePlan struct {
+	Repository string          `json:"repository"`
+	Branch     string          `json:"branch"`
+	CreatedAt  time.Time       `json:"created_at"`
+	Actions    []PlannedAction `json:"actions"`
+	Error      string          `json:"error,omitempty"`
+}
+
+// dryRunAPI passes reads through to the real API and records writes in the plan instead
+type dryRunAPI struct {
+	BitbucketAPI
+	plan    *CascadePlan
+	planned map[int64]PlannedAction
+}
+
+func newDryRunAPI(api BitbucketAPI, plan *CascadePlan) *dryRunAPI {
+	return &dryRunAPI{api, plan, make(map[int64]PlannedAction)}
+}
+
+func (api *dryRunAPI) CreatePullRequest(repoOwner string, repoSlug string, options PullRequestOptions) (*PullRequest, error) {
+	id := -int64(len(api.planned) + 1)
+	action := PlannedAction{
+		Action:        "create",
+		Repository:    repoOwner + "/" + repoSlug,
+		PullRequestID: id,
+		Source:        options.SourceBranch,
+		Destination:   options.DestinationBranch,
+		Title:         options.Title,
+		Reviewers:     options.Reviewers,
+	}
+	api.planned[id] = action
+	api.record(action)
+
+	pr := &PullRequest{ID: id, Title: options.Title, Description: options.Description, State: "OPEN"}
+	pr.Source.Branch.Name = options.SourceBranch
+	pr.Destination.Branch.Name = options.DestinationBranch
+	return pr, nil
+}
+
+func (api *dryRunAPI) ApprovePullRequest(repoOwner string, repoSlug string, pullRequestId int64) error {
+	api.record(api.actionOn("approve", repoOwner, repoSlug, pullRequestId))
+	return nil
+}
+
+func (api *dryRunAPI) MergePullRequest(repoOwner string, repoSlug string, pullRequestId int64, options MergeOptions) error {
+	action := api.actionOn("merge", repoOwner, repoSlug, pullRequestId)
+	action.MergeStrategy = options.Strategy
+	api.record(action)
+	return nil
+}
+
+func (api *dryRunAPI) PostComment(repoOwner string, repoSlug string, pullRequestId int64, content string) error {
+	api.record(api.actionOn("comment", repoOwner, repoSlug, pullRequestId))
+	return nil
+}
+
+func (api *dryRunAPI) UpdatePullRequest(repoOwner string, repoSlug string, pullRequestId int64, update PullRequestUpdate) error {
+	action := api.actionOn("update", repoOwner, repoSlug, pullRequestId)
+	if update.Title != "" {
+		action.Title = update.Title
+	}
+	if update.Reviewers != nil {
+		action.Reviewers = update.Reviewers
+	}
+	api.record(action)
+	return nil
+}
+
+func (api *dryRunAPI) DeclinePullRequest(repoOwner string, repoSlug string, pullRequestId int64) error {
+	api.record(api.actionOn("decline", repoOwner, repoSlug, pullRequestId))
+	return nil
+}
+
+func (api *dryRunAPI) CreateBranch(repoOwner string, repoSlug string, name string, commitHash string) error {
+	api.record(PlannedAction{Action: "branch", Repository: repoOwner + "/" + repoSlug, Source: commitHash, Destination: name})
+	return nil
+}
+
+// actionOn describes an action on an existing or planned pull request
+func (api *dryRunAPI) actionOn(kind string, repoOwner string, repoSlug string, pullRequestId int64) PlannedAction {
+	action, ok := api.planned[pullRequestId]
+	if !ok {
+		action = PlannedAction{Repository: repoOwner + "/" + repoSlug, PullRequestID: pullRequestId}
+	}
+	action.Action = kind
+	return action
+}
+
+func (api *dryRunAPI) record(action PlannedAction) {
+	log.Println("DRY RUN -> ", action.Action, action.Repository, action.PullRequestID, action.Source, "->", action.Destination)
+	api.plan.Actions = append(api.plan.Actions, action)
+}
+
+// PlanLog keeps the most recent plans for the /plans endpoint
+type PlanLog struct {
+	size int
+
+	mu    sync.Mutex
+	plans []*CascadePlan
+}
+
+func NewPlanLog(size int) *PlanLog {
+	return &PlanLog{size: size}
+}
+
+func (planLog *PlanLog) Add(plan *CascadePlan) {
+	planLog.mu.Lock()
+	defer planLog.mu.Unlock()
+
+	planLog.plans = append(planLog.plans, plan)
+	if len(planLog.plans) > planLog.size {
+		planLog.plans = planLog.plans[len(planLog.plans)-planLog.size:]
+	}
+}
+
+// Recent returns the plans newest first
+func (planLog *PlanLog) Recent() []*CascadePlan {
+	planLog.mu.Lock()
+	defer planLog.mu.Unlock()
+
+	plans := make([]*CascadePlan, len(planLog.plans))
+	for i, plan := range planLog.plans {
+		plans[len(plans)-1-i] = plan
+	}
+	return plans
+}
+
+// dryRun returns a copy of the service whose mutating calls are recorded in plan
+func (service *BitbucketService) dryRun(plan *CascadePlan) *BitbucketService {
+	dry := *service
+	dry.bitbucketAPI = newDryRunAPI(service.bitbucketAPI, plan)
+	dry.plan = plan
+	return &dry
+}
+
+// PlanMerge computes what OnMerge would do for the merged pull request without touching Bitbucket.
+// Each planned pull request is run through the auto approve & merge rules, and each planned merge
+// through OnMerge again, so the plan covers the whole cascade.
+func (service *BitbucketService) PlanMerge(request *PullRequestMergedPayload) (*CascadePlan, error) {
+	plan := &CascadePlan{
+		Repository: request.Repository.FullName,
+		Branch:     request.PullRequest.Destination.Branch.Name,
+		CreatedAt:  time.Now(),
+	}
+	dry := service.dryRun(plan)
+	settings := service.Registry.For(request.Repository.FullName)
+
+	err := dry.OnMerge(request)
+	// Actions grow while walking them, the pipeline is acyclic so this ends
+	for i := 0; err == nil && i < len(plan.Actions); i++ {
+		action := plan.Actions[i]
+		switch {
+		case action.Action == "create" && settings.AutoMerge:
+			pr := &PullRequest{ID: action.PullRequestID}
+			pr.Destination.Branch.Name = action.Destination
+			err = dry.ApprovePullRequest(settings, request.Repository.Owner.UUID, request.Repository.Name, pr)
+		case action.Action == "merge" && action.PullRequestID < 0:
+			next := *request
+			next.PullRequest.Title = action.Title
+			next.PullRequest.Source.Branch.Name = action.Source
+			next.PullRequest.Destination.Branch.Name = action.Destination
+			err = dry.OnMerge(&next)
+		}
+	}
+	return service.finishPlan(plan, err)
+}
+
+// runPlanned runs fn against a dry run copy of the service and keeps the resulting plan
+func (service *BitbucketService) runPlanned(repository string, branch string, fn func(dry *BitbucketService) error) (*CascadePlan, error) {
+	plan := &CascadePlan{Repository: repository, Branch: branch, CreatedAt: time.Now()}
+	return service.finishPlan(plan, fn(service.dryRun(plan)))
+}
+
+func (service *BitbucketService) finishPlan(plan *CascadePlan, err error) (*CascadePlan, error) {
+	if err != nil {
+		plan.Error = err.Error()
+	}
+	log.Println("DRY RUN plan for ", plan.Repository, plan.Branch, ": ", service.PrettyPrint(plan))
+	service.plans.Add(plan)
+	return plan, err
+}
+
+// RecentPlans returns the latest dry run plans, newest first
+func (service *BitbucketService) RecentPlans() []*CascadePlan {
+	return service.plans.Recent()
+}
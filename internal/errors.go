@@ -0,0 +1,74 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ktrysmt/go-bitbucket"
+)
+
+// ErrBadPayload marks a webhook body that can never be processed, retrying it will not help
+var ErrBadPayload = errors.New("bad payload")
+
+// UpstreamError is a failed Bitbucket API call
+type UpstreamError struct {
+	Operation string
+	// StatusCode is 0 when no response was received
+	StatusCode int
+	Err        error
+}
+
+func (e *UpstreamError) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("%s: bitbucket responded %d: %v", e.Operation, e.StatusCode, e.Err)
+	}
+	return fmt.Sprintf("%s: %v", e.Operation, e.Err)
+}
+
+func (e *UpstreamError) Unwrap() error {
+	return e.Err
+}
+
+// NewUpstreamError wraps an error from the Bitbucket client, keeping the response status when there is one
+func NewUpstreamError(operation string, err error) error {
+	if err == nil {
+		return nil
+	}
+	upstream := &UpstreamError{Operation: operation, Err: err}
+	var statusErr *bitbucket.UnexpectedResponseStatusError
+	if errors.As(err, &statusErr) {
+		// Status looks like "404 Not Found"
+		if code, convErr := strconv.Atoi(strings.SplitN(statusErr.Status, " ", 2)[0]); convErr == nil {
+			upstream.StatusCode = code
+		}
+		upstream.Err = statusErr.ErrorWithBody()
+	}
+	return upstream
+}
+
+// Retryable reports whether a failed job may succeed on a later attempt
+func Retryable(err error) bool {
+	if errors.Is(err, ErrBadPayload) {
+		return false
+	}
+	var upstream *UpstreamError
+	if errors.As(err, &upstream) && upstream.StatusCode >= 400 && upstream.StatusCode < 500 {
+		return upstream.StatusCode == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// HTTPStatus maps an error to the status code returned to the caller
+func HTTPStatus(err error) int {
+	if errors.Is(err, ErrBadPayload) {
+		return http.StatusBadRequest
+	}
+	var upstream *UpstreamError
+	if errors.As(err, &upstream) {
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,336 @@
+package internal
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Job is a webhook delivery persisted until it has been processed
+type Job struct {
+	ID            string    `json:"id"`
+	EventKey      string    `json:"event_key"`
+	Payload       []byte    `json:"payload"`
+	Attempts      int       `json:"attempts"`
+	CreatedAt     time.Time `json:"created_at"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+	LastError     string    `json:"last_error,omitempty"`
+	// FailedAt is when the queue gave up on the job
+	FailedAt time.Time `json:"failed_at,omitempty"`
+}
+
+// JobHandler processes a job, a Retryable error has it retried with backoff
+type JobHandler func(job *Job) error
+
+// JobQueue is a directory backed at-least-once queue worked by a bounded pool of workers.
+// Every pending job is a <id>.json file, jobs that exhausted their attempts move to failed/.
+type JobQueue struct {
+	dir         string
+	workers     int
+	maxAttempts int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+
+	handler JobHandler
+	jobs    chan *Job
+	// depth counts the pending jobs, queued or waiting to be retried
+	depth int64
+	quit  chan struct{}
+	wg    sync.WaitGroup
+}
+
+const jobFileExt = ".json"
+
+func NewJobQueue(dir string, workers int, maxAttempts int, baseDelay time.Duration) (*JobQueue, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "failed"), 0700); err != nil {
+		return nil, err
+	}
+
+	return &JobQueue{
+		dir:         dir,
+		workers:     workers,
+		maxAttempts: maxAttempts,
+		baseDelay:   baseDelay,
+		maxDelay:    10 * time.Minute,
+		jobs:        make(chan *Job),
+		quit:        make(chan struct{}),
+	}, nil
+}
+
+// Start resumes the jobs left over from a previous run and starts the workers
+func (queue *JobQueue) Start(handler JobHandler) error {
+	queue.handler = handler
+
+	pending, err := queue.load()
+	if err != nil {
+		return err
+	}
+	log.Println("JobQueue -> resuming pending jobs: ", len(pending))
+	atomic.AddInt64(&queue.depth, int64(len(pending)))
+
+	for i := 0; i < queue.workers; i++ {
+		queue.wg.Add(1)
+		go queue.work()
+	}
+	for _, job := range pending {
+		queue.schedule(job)
+	}
+	return nil
+}
+
+// Stop stops handing out jobs and waits up to timeout for the running ones to finish. Jobs that
+// were still waiting stay on disk and are resumed by the next Start.
+func (queue *JobQueue) Stop(timeout time.Duration) bool {
+	close(queue.quit)
+
+	done := make(chan struct{})
+	go func() {
+		queue.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		log.Println("JobQueue -> drained")
+		return true
+	case <-time.After(timeout):
+		log.Println("JobQueue -> gave up waiting for running jobs after ", timeout)
+		return false
+	}
+}
+
+// Depth returns the number of pending jobs, queued or waiting to be retried
+func (queue *JobQueue) Depth() int {
+	return int(atomic.LoadInt64(&queue.depth))
+}
+
+// Enqueue persists a job before handing it to the workers, so it survives a restart
+func (queue *JobQueue) Enqueue(eventKey string, payload []byte) (*Job, error) {
+	id, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	job := &Job{
+		ID:            id,
+		EventKey:      eventKey,
+		Payload:       payload,
+		CreatedAt:     now,
+		NextAttemptAt: now,
+	}
+	if err := queue.save(job); err != nil {
+		return nil, err
+	}
+	log.Println("JobQueue -> enqueued: ", job.ID, job.EventKey)
+	atomic.AddInt64(&queue.depth, 1)
+
+	queue.schedule(job)
+	return job, nil
+}
+
+func (queue *JobQueue) work() {
+	defer queue.wg.Done()
+	for {
+		select {
+		case <-queue.quit:
+			return
+		case job := <-queue.jobs:
+			queue.run(job)
+		}
+	}
+}
+
+func (queue *JobQueue) run(job *Job) {
+	job.Attempts++
+	log.Println("JobQueue -> processing: ", job.ID, job.EventKey, "attempt", job.Attempts)
+
+	err := queue.handle(job)
+	if err == nil {
+		atomic.AddInt64(&queue.depth, -1)
+		if err := os.Remove(queue.path(job.ID)); err != nil {
+			log.Println("JobQueue -> could not remove completed job: ", job.ID, err)
+		}
+		return
+	}
+
+	job.LastError = err.Error()
+	if job.Attempts >= queue.maxAttempts || !Retryable(err) {
+		log.Println("JobQueue -> giving up on job: ", job.ID, err)
+		atomic.AddInt64(&queue.depth, -1)
+		job.FailedAt = time.Now()
+		//Keep the last error with the failed job
+		if err := queue.save(job); err != nil {
+			log.Println("JobQueue -> could not persist failure: ", job.ID, err)
+		}
+		if err := os.Rename(queue.path(job.ID), filepath.Join(queue.dir, "failed", job.ID+jobFileExt)); err != nil {
+			log.Println("JobQueue -> could not move failed job: ", job.ID, err)
+		}
+		return
+	}
+
+	delay := queue.backoff(job.Attempts)
+	job.NextAttemptAt = time.Now().Add(delay)
+	log.Println("JobQueue -> retrying job in ", delay, ": ", job.ID, err)
+	if err := queue.save(job); err != nil {
+		log.Println("JobQueue -> could not persist retry: ", job.ID, err)
+	}
+	queue.schedule(job)
+}
+
+// handle runs the handler, turning a panic into an error so one bad job cannot take the process down
+func (queue *JobQueue) handle(job *Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return queue.handler(job)
+}
+
+// schedule hands the job to a worker once it is due
+func (queue *JobQueue) schedule(job *Job) {
+	go func() {
+		if wait := time.Until(job.NextAttemptAt); wait > 0 {
+			timer := time.NewTimer(wait)
+			defer timer.Stop()
+			select {
+			case <-queue.quit:
+				return
+			case <-timer.C:
+			}
+		}
+		select {
+		case <-queue.quit:
+		case queue.jobs <- job:
+		}
+	}()
+}
+
+// backoff doubles the base delay for every failed attempt, up to maxDelay
+func (queue *JobQueue) backoff(attempts int) time.Duration {
+	delay := queue.baseDelay
+	for i := 1; i < attempts && delay < queue.maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > queue.maxDelay {
+		delay = queue.maxDelay
+	}
+	return delay
+}
+
+func (queue *JobQueue) path(id string) string {
+	return filepath.Join(queue.dir, id+jobFileExt)
+}
+
+// save writes the job atomically so a crash never leaves a partial job
+func (queue *JobQueue) save(job *Job) error {
+	buf, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(queue.path(job.ID), buf)
+}
+
+// load reads the pending jobs in creation order
+func (queue *JobQueue) load() ([]*Job, error) {
+	return loadJobs(queue.dir)
+}
+
+// Pending returns the jobs of an event key queued or waiting to be retried, in creation order
+func (queue *JobQueue) Pending(eventKey string) ([]*Job, error) {
+	jobs, err := queue.load()
+	if err != nil {
+		return nil, err
+	}
+	var pending []*Job
+	for _, job := range jobs {
+		if job.EventKey == eventKey {
+			pending = append(pending, job)
+		}
+	}
+	return pending, nil
+}
+
+// Failures returns the latest jobs that failed, given up on or still being retried, newest first
+func (queue *JobQueue) Failures(limit int) ([]*Job, error) {
+	failed, err := loadJobs(filepath.Join(queue.dir, "failed"))
+	if err != nil {
+		return nil, err
+	}
+	pending, err := queue.load()
+	if err != nil {
+		return nil, err
+	}
+	for _, job := range pending {
+		if job.LastError != "" {
+			failed = append(failed, job)
+		}
+	}
+
+	sort.Slice(failed, func(i, j int) bool {
+		return failed[i].CreatedAt.After(failed[j].CreatedAt)
+	})
+	if len(failed) > limit {
+		failed = failed[:limit]
+	}
+	return failed, nil
+}
+
+// loadJobs reads the jobs of a directory in creation order
+func loadJobs(dir string) ([]*Job, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []*Job
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), jobFileExt) {
+			continue
+		}
+		buf, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		//Completed or moved by a worker meanwhile
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var job Job
+		if err := json.Unmarshal(buf, &job); err != nil {
+			log.Println("JobQueue -> skipping unreadable job: ", file.Name(), err)
+			continue
+		}
+		jobs = append(jobs, &job)
+	}
+
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].CreatedAt.Before(jobs[j].CreatedAt)
+	})
+	return jobs, nil
+}
+
+// newJobID is sortable by creation time and unique across restarts
+func newJobID() (string, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d-%s", time.Now().UnixNano(), hex.EncodeToString(suffix)), nil
+}
@@ -0,0 +1,190 @@
+package internal
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitFor polls condition until it holds or a second has passed
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !condition(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func countFiles(t *testing.T, dir string) int {
+	t.Helper()
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for _, file := range files {
+		if !file.IsDir() {
+			count++
+		}
+	}
+	return count
+}
+
+func TestJobQueueRetries(t *testing.T) {
+	retryable := &UpstreamError{Operation: "MergePullRequest", StatusCode: 503, Err: errors.New("unavailable")}
+
+	tests := []struct {
+		name string
+		// errs are returned by the attempts in turn, nil after them
+		errs     []error
+		panics   bool
+		attempts int
+		failed   bool
+	}{
+		{name: "succeeds", attempts: 1},
+		{name: "succeeds on retry", errs: []error{retryable, retryable}, attempts: 3},
+		{name: "gives up after max attempts", errs: []error{retryable, retryable, retryable, retryable}, attempts: 3, failed: true},
+		{name: "gives up on a bad payload", errs: []error{ErrBadPayload}, attempts: 1, failed: true},
+		{name: "client error", errs: []error{&UpstreamError{Operation: "GetPullRequest", StatusCode: 404, Err: errors.New("not found")}}, attempts: 1, failed: true},
+		{name: "panic is retried", panics: true, attempts: 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			queue, err := NewJobQueue(dir, 2, 3, time.Millisecond)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var mu sync.Mutex
+			attempts := 0
+			done := make(chan *Job, 1)
+			err = queue.Start(func(job *Job) error {
+				mu.Lock()
+				attempts++
+				attempt := attempts
+				mu.Unlock()
+
+				if test.panics && attempt == 1 {
+					panic("bad job")
+				}
+				var err error
+				if attempt <= len(test.errs) {
+					err = test.errs[attempt-1]
+				}
+				if err == nil || attempt == 3 || !Retryable(err) {
+					done <- job
+				}
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer queue.Stop(time.Second)
+
+			if _, err := queue.Enqueue("pullrequest:fulfilled", []byte(`{}`)); err != nil {
+				t.Fatal(err)
+			}
+			job := <-done
+			waitFor(t, "the job to complete", func() bool { return queue.Depth() == 0 })
+			waitFor(t, "the job file to move", func() bool { return countFiles(t, dir) == 0 })
+
+			if job.Attempts != test.attempts {
+				t.Errorf("attempts = %d, want %d", job.Attempts, test.attempts)
+			}
+			failed, err := queue.Failures(10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (len(failed) == 1) != test.failed {
+				t.Fatalf("failures = %d, want failed %v", len(failed), test.failed)
+			}
+			if test.failed && (failed[0].LastError == "" || failed[0].FailedAt.IsZero()) {
+				t.Errorf("failed job = %+v, want the last error and when it failed", failed[0])
+			}
+		})
+	}
+}
+
+func TestJobQueueResumesAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	retryable := &UpstreamError{Operation: "MergePullRequest", StatusCode: 503, Err: errors.New("unavailable")}
+
+	// The first attempt fails and the retry is an hour away when the process stops
+	queue, err := NewJobQueue(dir, 1, 3, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attempted := make(chan struct{}, 1)
+	if err := queue.Start(func(job *Job) error {
+		attempted <- struct{}{}
+		return retryable
+	}); err != nil {
+		t.Fatal(err)
+	}
+	enqueued, err := queue.Enqueue("pullrequest:fulfilled", []byte(`{"id":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-attempted
+	waitFor(t, "the retry to be persisted", func() bool {
+		pending, _ := queue.Pending("pullrequest:fulfilled")
+		return len(pending) == 1 && pending[0].Attempts == 1
+	})
+	if !queue.Stop(time.Second) {
+		t.Fatal("queue didn't stop")
+	}
+
+	restarted, err := NewJobQueue(dir, 1, 3, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan *Job, 1)
+	// The retry keeps its schedule, pull it in to not wait the hour
+	pending, _ := restarted.Pending("pullrequest:fulfilled")
+	pending[0].NextAttemptAt = time.Now()
+	if err := restarted.save(pending[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := restarted.Start(func(job *Job) error {
+		done <- job
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Stop(time.Second)
+
+	job := <-done
+	if job.ID != enqueued.ID || string(job.Payload) != `{"id":1}` || job.Attempts != 2 {
+		t.Errorf("resumed job = %+v, want %s on its second attempt", job, enqueued.ID)
+	}
+	waitFor(t, "the job to complete", func() bool { return restarted.Depth() == 0 })
+	waitFor(t, "the job file to be removed", func() bool { return countFiles(t, dir) == 0 })
+	if failed := countFiles(t, filepath.Join(dir, "failed")); failed != 0 {
+		t.Errorf("%d failed jobs, want none", failed)
+	}
+}
+
+func TestJobQueueBackoff(t *testing.T) {
+	queue := &JobQueue{baseDelay: time.Second, maxDelay: 10 * time.Second}
+
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{attempts: 1, want: time.Second},
+		{attempts: 2, want: 2 * time.Second},
+		{attempts: 4, want: 8 * time.Second},
+		{attempts: 5, want: 10 * time.Second},
+		{attempts: 50, want: 10 * time.Second},
+	}
+	for _, test := range tests {
+		if got := queue.backoff(test.attempts); got != test.want {
+			t.Errorf("backoff(%d) = %v, want %v", test.attempts, got, test.want)
+		}
+	}
+}
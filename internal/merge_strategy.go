@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MergeOptions picks the merge strategy of the destination stage, checked against the strategies the
+// branch allows, and generates a merge commit message referencing the original pull request
+func (service *BitbucketService) MergeOptions(settings *RepositorySettings, repoOwner string, repoName string, pr *PullRequest) (MergeOptions, error) {
+	//The message only loses its cascade line without the bot
+	bot, err := service.currentUser()
+	if err != nil {
+		log.Println("CurrentUser -> err: ", err)
+	}
+	options := MergeOptions{Message: mergeMessage(pr, bot)}
+
+	dest := pr.Destination.Branch.Name
+	if stage := settings.ParseBranch(dest).Stage; stage != nil {
+		options.Strategy = stage.MergeStrategy
+	}
+	if options.Strategy == "" {
+		return options, nil
+	}
+
+	branches, err := service.listBranches(settings, repoName, repoOwner)
+	if err != nil {
+		return options, err
+	}
+	for _, branch := range branches {
+		if branch.Name != dest || len(branch.MergeStrategies) == 0 {
+			continue
+		}
+		if !containsString(branch.MergeStrategies, options.Strategy) {
+			return options, fmt.Errorf("merge strategy %s is not allowed on %s, allowed: %s",
+				options.Strategy, dest, strings.Join(branch.MergeStrategies, ", "))
+		}
+	}
+	return options, nil
+}
+
+// blockMerge records a cascade pull request that won't be merged automatically for reason, the first
+// time the author is tagged in a comment
+func (service *BitbucketService) blockMerge(settings *RepositorySettings, repoOwner string, repoName string, pr *PullRequest, reason string) error {
+	fullName := repositoryName(pr, repoOwner, repoName)
+	if previous := service.blocked.Get(fullName, pr.ID); previous != nil && previous.Reason == reason {
+		return nil
+	}
+
+	blocked := &BlockedCascade{
+		Repository:    fullName,
+		PullRequestID: pr.ID,
+		Title:         pr.Title,
+		Source:        pr.Source.Branch.Name,
+		Destination:   pr.Destination.Branch.Name,
+		Author:        service.cascadeAuthor(pr),
+		Reason:        reason,
+		DetectedAt:    time.Now(),
+	}
+	//Planned pull requests don't exist yet
+	if pr.ID > 0 {
+		if err := service.bitbucketAPI.PostComment(repoOwner, repoName, pr.ID, blockedMergeComment(blocked)); err != nil {
+			return err
+		}
+	}
+	if service.plan == nil {
+		service.blocked.Put(blocked)
+		CascadePullRequests.Inc("skipped", settings.stageName(blocked.Destination))
+	}
+	return nil
+}
+
+func blockedMergeComment(blocked *BlockedCascade) string {
+	comment := ""
+	if blocked.Author != "" {
+		comment = "@{" + blocked.Author + "} "
+	}
+	return comment + "this cascade of `" + blocked.Source + "` into `" + blocked.Destination +
+		"` will not be merged automatically: " + blocked.Reason + ".\n\nPlease merge it by hand, the cascade continues once this pull request merges."
+}
+
+func mergeMessage(pr *PullRequest, bot *Owner) string {
+	message := "Merged in " + pr.Source.Branch.Name + " (pull request #" + strconv.FormatInt(pr.ID, 10) + ")\n\n" + pr.Title
+	if origin := OriginOf(pr, bot); origin.PullRequestID != pr.ID {
+		message += "\n\nCascade of pull request #" + strconv.FormatInt(origin.PullRequestID, 10)
+	}
+	return message
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
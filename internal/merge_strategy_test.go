@@ -0,0 +1,147 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+// strategyConfig merges into dev with merge commits and into qa fast forward
+func strategyConfig() *CascadeFile {
+	return &CascadeFile{RepositoryConfig: RepositoryConfig{Stages: []*CascadeStage{
+		{Name: "develop", Pattern: "develop"},
+		{Name: "dev", Pattern: "dev/*", MergeStrategy: "merge_commit"},
+		{Name: "qa", Pattern: "qa/*", MergeStrategy: "fast_forward"},
+	}}}
+}
+
+func TestMergeOptions(t *testing.T) {
+	service, fake := newTestService(t, strategyConfig())
+	fake.SetMergeStrategies(testOwner, testSlug, "dev/acme", "merge_commit", "squash")
+	fake.SetMergeStrategies(testOwner, testSlug, "qa/acme", "merge_commit")
+	settings := service.Registry.For(testOwner + "/" + testSlug)
+
+	tests := []struct {
+		name        string
+		pr          *PullRequest
+		strategy    string
+		err         bool
+		cascadeLine bool
+	}{
+		{
+			name: "stage without a strategy",
+			pr:   testPullRequest("Add the feature", Owner{AccountId: "alice"}, ""),
+		},
+		{
+			name:        "allowed strategy",
+			pr:          testPullRequest("#AutoCascade Add the feature", *testBot, originLines),
+			strategy:    "merge_commit",
+			cascadeLine: true,
+		},
+		{
+			name:        "strategy the branch doesn't allow",
+			pr:          testPullRequest("#AutoCascade Add the feature", *testBot, originLines),
+			strategy:    "fast_forward",
+			err:         true,
+			cascadeLine: true,
+		},
+		{
+			name:     "branch allowing every strategy",
+			pr:       testPullRequest("Add the feature", Owner{AccountId: "alice"}, originLines),
+			strategy: "fast_forward",
+		},
+	}
+	destinations := []string{"develop", "dev/acme", "qa/acme", "qa/globex"}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.pr.Destination.Branch.Name = destinations[i]
+
+			options, err := service.MergeOptions(settings, testOwner, testSlug, test.pr)
+			if (err != nil) != test.err {
+				t.Fatalf("MergeOptions() err = %v, want err %v", err, test.err)
+			}
+			if options.Strategy != test.strategy {
+				t.Errorf("Strategy = %q, want %q", options.Strategy, test.strategy)
+			}
+			if !strings.HasPrefix(options.Message, "Merged in dev/acme (pull request #5)\n\n"+test.pr.Title) {
+				t.Errorf("Message = %q", options.Message)
+			}
+			if got := strings.Contains(options.Message, "Cascade of pull request #1"); got != test.cascadeLine {
+				t.Errorf("Message = %q, want the cascade line %v", options.Message, test.cascadeLine)
+			}
+		})
+	}
+}
+
+func TestMergeMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		pr   *PullRequest
+		bot  *Owner
+		want string
+	}{
+		{
+			name: "cascade pull request",
+			pr:   testPullRequest("#AutoCascade Add the feature", *testBot, originLines),
+			bot:  testBot,
+			want: "Merged in dev/acme (pull request #5)\n\n#AutoCascade Add the feature\n\nCascade of pull request #1",
+		},
+		{
+			name: "human pull request",
+			pr:   testPullRequest("Add the feature", Owner{AccountId: "alice"}, originLines),
+			bot:  testBot,
+			want: "Merged in dev/acme (pull request #5)\n\nAdd the feature",
+		},
+		{
+			name: "bot unknown",
+			pr:   testPullRequest("#AutoCascade Add the feature", *testBot, originLines),
+			want: "Merged in dev/acme (pull request #5)\n\n#AutoCascade Add the feature",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := mergeMessage(test.pr, test.bot); got != test.want {
+				t.Errorf("mergeMessage() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMergePullRequestBlocksRejectedStrategies(t *testing.T) {
+	service, fake := newTestService(t, strategyConfig())
+	fake.SetMergeStrategies(testOwner, testSlug, "qa/acme", "merge_commit")
+	fake.AddCommit(testOwner, testSlug, "dev/acme", "feature1", "Add the feature")
+	settings := service.Registry.For(testOwner + "/" + testSlug)
+
+	pr, err := fake.CreatePullRequest(testOwner, testSlug, PullRequestOptions{
+		Title:             "#AutoCascade Add the feature",
+		Description:       originLines,
+		SourceBranch:      "dev/acme",
+		DestinationBranch: "qa/acme",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	skipped := counterValue(CascadePullRequests, "skipped", "qa")
+
+	// Every later event tries again, the author is only told once
+	for i := 0; i < 2; i++ {
+		if err := service.MergePullRequest(settings, testOwner, testSlug, pr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if open := openCascades(fake); open["qa/acme"].ID != pr.ID {
+		t.Errorf("pull request into qa/acme is no longer open")
+	}
+	comments := fake.Comments(testOwner, testSlug, pr.ID)
+	if len(comments) != 1 || !strings.HasPrefix(comments[0], "@{alice} ") || !strings.Contains(comments[0], "fast_forward is not allowed") {
+		t.Errorf("comments = %q, want one tagging alice with the reason", comments)
+	}
+	blocked := service.blocked.Get(testOwner+"/"+testSlug, pr.ID)
+	if blocked == nil || !strings.Contains(blocked.Reason, "fast_forward is not allowed") {
+		t.Errorf("blocked = %+v, want the rejected strategy", blocked)
+	}
+	if got := counterValue(CascadePullRequests, "skipped", "qa") - skipped; got != 1 {
+		t.Errorf("skipped %v pull requests, want 1", got)
+	}
+}
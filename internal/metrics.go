@@ -0,0 +1,359 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics are exposed on /metrics in the Prometheus text format. They are kept in memory and start
+// from zero on every restart, Prometheus handles the counter resets.
+var (
+	WebhookEvents = NewCounterVec("cascade_webhook_events_total",
+		"Valid webhook deliveries received, by X-Event-Key (other for unknown keys).", "event_key")
+	DuplicateDeliveries = NewCounterVec("cascade_webhook_duplicate_deliveries_total",
+		"Webhook deliveries skipped as retries or redeliveries of one already accepted.")
+	CascadePullRequests = NewCounterVec("cascade_pull_requests_total",
+		"Cascade pull requests created, merged or skipped, by destination stage.", "action", "stage")
+	BitbucketRequests = NewCounterVec("cascade_bitbucket_requests_total",
+		"Bitbucket API calls by operation and response status (2xx on success, error without a response).", "operation", "code")
+	BitbucketRequestDuration = NewHistogramVec("cascade_bitbucket_request_duration_seconds",
+		"Bitbucket API call latency by operation, retries included.",
+		[]float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}, "operation")
+	CascadeLeadTime = NewHistogramVec("cascade_lead_time_seconds",
+		"Time from the merge of the original pull request to the merge of its cascade into a release branch.",
+		[]float64{300, 900, 3600, 4 * 3600, 12 * 3600, 24 * 3600, 3 * 24 * 3600, 7 * 24 * 3600, 14 * 24 * 3600}, "repository")
+)
+
+// metricFamily is a metric written by WriteMetrics
+type metricFamily interface {
+	write(w io.Writer)
+}
+
+var metricsMu sync.Mutex
+var metricFamilies []metricFamily
+
+func registerMetric(family metricFamily) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	metricFamilies = append(metricFamilies, family)
+}
+
+// WriteMetrics writes every metric in the Prometheus text exposition format
+func WriteMetrics(w io.Writer) {
+	metricsMu.Lock()
+	families := append([]metricFamily(nil), metricFamilies...)
+	metricsMu.Unlock()
+
+	for _, family := range families {
+		family.write(w)
+	}
+}
+
+// CounterVec is a counter with a value per combination of label values
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	counter := &CounterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	registerMetric(counter)
+	return counter
+}
+
+// Inc adds one for the label values, given in the order of the labels
+func (counter *CounterVec) Inc(labelValues ...string) {
+	counter.mu.Lock()
+	defer counter.mu.Unlock()
+	counter.values[seriesKey(labelValues)]++
+}
+
+func (counter *CounterVec) write(w io.Writer) {
+	counter.mu.Lock()
+	defer counter.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", counter.name, counter.help, counter.name)
+	for _, key := range sortedKeys(counter.values) {
+		fmt.Fprintf(w, "%s%s %s\n", counter.name, labelPairs(counter.labels, key), formatFloat(counter.values[key]))
+	}
+}
+
+// HistogramVec is a histogram with a series per combination of label values
+type HistogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	histogram := &HistogramVec{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogram)}
+	registerMetric(histogram)
+	return histogram
+}
+
+// Observe records a value for the label values, given in the order of the labels
+func (vec *HistogramVec) Observe(value float64, labelValues ...string) {
+	vec.mu.Lock()
+	defer vec.mu.Unlock()
+
+	key := seriesKey(labelValues)
+	series, ok := vec.series[key]
+	if !ok {
+		series = &histogram{counts: make([]uint64, len(vec.buckets))}
+		vec.series[key] = series
+	}
+	for i, bound := range vec.buckets {
+		if value <= bound {
+			series.counts[i]++
+		}
+	}
+	series.count++
+	series.sum += value
+}
+
+// Since records the seconds elapsed since start
+func (vec *HistogramVec) Since(start time.Time, labelValues ...string) {
+	vec.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (vec *HistogramVec) write(w io.Writer) {
+	vec.mu.Lock()
+	defer vec.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", vec.name, vec.help, vec.name)
+	keys := make([]string, 0, len(vec.series))
+	for key := range vec.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	bucketLabels := append(append([]string(nil), vec.labels...), "le")
+	for _, key := range keys {
+		series := vec.series[key]
+		for i, bound := range vec.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", vec.name, labelPairs(bucketLabels, key+"\xff"+formatFloat(bound)), series.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", vec.name, labelPairs(bucketLabels, key+"\xff+Inf"), series.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", vec.name, labelPairs(vec.labels, key), formatFloat(series.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", vec.name, labelPairs(vec.labels, key), series.count)
+	}
+}
+
+// GaugeFunc is a gauge read when the metrics are written
+type GaugeFunc struct {
+	name  string
+	help  string
+	value func() float64
+}
+
+func NewGaugeFunc(name string, help string, value func() float64) *GaugeFunc {
+	gauge := &GaugeFunc{name: name, help: help, value: value}
+	registerMetric(gauge)
+	return gauge
+}
+
+func (gauge *GaugeFunc) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", gauge.name, gauge.help, gauge.name, gauge.name, formatFloat(gauge.value()))
+}
+
+// seriesKey joins label values with a byte that can't appear in valid UTF-8
+func seriesKey(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// labelPairs renders {name="value",...} for a series key, nothing without labels
+func labelPairs(labels []string, key string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	values := strings.Split(key, "\xff")
+	pairs := make([]string, len(labels))
+	for i, label := range labels {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = label + "=\"" + labelEscaper.Replace(value) + "\""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// labelEscaper escapes label values as the text format expects
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// MetricsHandler serves the metrics to Prometheus
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	WriteMetrics(w)
+}
+
+/*** METRICS -> BITBUCKET API CALLS ***/
+/* ================================== */
+
+// metricsAPI times every Bitbucket API call and counts them by response status
+type metricsAPI struct {
+	api BitbucketAPI
+}
+
+var _ BitbucketAPI = (*metricsAPI)(nil)
+
+// NewMetricsAPI records the latency and status code of every call made through api
+func NewMetricsAPI(api BitbucketAPI) BitbucketAPI {
+	return &metricsAPI{api: api}
+}
+
+// observe records a call started at start that returned err
+func (api *metricsAPI) observe(operation string, start time.Time, err error) {
+	BitbucketRequestDuration.Since(start, operation)
+	code := "2xx"
+	if err != nil {
+		code = "error"
+		var upstream *UpstreamError
+		if errors.As(err, &upstream) && upstream.StatusCode != 0 {
+			code = strconv.Itoa(upstream.StatusCode)
+		}
+	}
+	BitbucketRequests.Inc(operation, code)
+}
+
+func (api *metricsAPI) ListBranches(repoOwner string, repoSlug string, nameFilter []string) ([]BranchRef, error) {
+	start := time.Now()
+	branches, err := api.api.ListBranches(repoOwner, repoSlug, nameFilter)
+	api.observe("ListBranches", start, err)
+	return branches, err
+}
+
+func (api *metricsAPI) ListPullRequests(repoOwner string, repoSlug string, filter PullRequestFilter) ([]PullRequest, error) {
+	start := time.Now()
+	pullRequests, err := api.api.ListPullRequests(repoOwner, repoSlug, filter)
+	api.observe("ListPullRequests", start, err)
+	return pullRequests, err
+}
+
+func (api *metricsAPI) GetPullRequest(repoOwner string, repoSlug string, pullRequestId int64) (*PullRequest, error) {
+	start := time.Now()
+	pr, err := api.api.GetPullRequest(repoOwner, repoSlug, pullRequestId)
+	api.observe("GetPullRequest", start, err)
+	return pr, err
+}
+
+func (api *metricsAPI) CreatePullRequest(repoOwner string, repoSlug string, options PullRequestOptions) (*PullRequest, error) {
+	start := time.Now()
+	pr, err := api.api.CreatePullRequest(repoOwner, repoSlug, options)
+	api.observe("CreatePullRequest", start, err)
+	return pr, err
+}
+
+func (api *metricsAPI) ApprovePullRequest(repoOwner string, repoSlug string, pullRequestId int64) error {
+	start := time.Now()
+	err := api.api.ApprovePullRequest(repoOwner, repoSlug, pullRequestId)
+	api.observe("ApprovePullRequest", start, err)
+	return err
+}
+
+func (api *metricsAPI) MergePullRequest(repoOwner string, repoSlug string, pullRequestId int64, options MergeOptions) error {
+	start := time.Now()
+	err := api.api.MergePullRequest(repoOwner, repoSlug, pullRequestId, options)
+	api.observe("MergePullRequest", start, err)
+	return err
+}
+
+func (api *metricsAPI) PostComment(repoOwner string, repoSlug string, pullRequestId int64, content string) error {
+	start := time.Now()
+	err := api.api.PostComment(repoOwner, repoSlug, pullRequestId, content)
+	api.observe("PostComment", start, err)
+	return err
+}
+
+func (api *metricsAPI) GetCommitStatuses(repoOwner string, repoSlug string, commitHash string) ([]CommitStatus, error) {
+	start := time.Now()
+	statuses, err := api.api.GetCommitStatuses(repoOwner, repoSlug, commitHash)
+	api.observe("GetCommitStatuses", start, err)
+	return statuses, err
+}
+
+func (api *metricsAPI) ListCommits(repoOwner string, repoSlug string, include string, exclude string) ([]Commit, error) {
+	start := time.Now()
+	commits, err := api.api.ListCommits(repoOwner, repoSlug, include, exclude)
+	api.observe("ListCommits", start, err)
+	return commits, err
+}
+
+func (api *metricsAPI) GetDiffStat(repoOwner string, repoSlug string, pullRequestId int64) ([]DiffStat, error) {
+	start := time.Now()
+	diffStat, err := api.api.GetDiffStat(repoOwner, repoSlug, pullRequestId)
+	api.observe("GetDiffStat", start, err)
+	return diffStat, err
+}
+
+func (api *metricsAPI) UpdatePullRequest(repoOwner string, repoSlug string, pullRequestId int64, update PullRequestUpdate) error {
+	start := time.Now()
+	err := api.api.UpdatePullRequest(repoOwner, repoSlug, pullRequestId, update)
+	api.observe("UpdatePullRequest", start, err)
+	return err
+}
+
+func (api *metricsAPI) DeclinePullRequest(repoOwner string, repoSlug string, pullRequestId int64) error {
+	start := time.Now()
+	err := api.api.DeclinePullRequest(repoOwner, repoSlug, pullRequestId)
+	api.observe("DeclinePullRequest", start, err)
+	return err
+}
+
+func (api *metricsAPI) CreateBranch(repoOwner string, repoSlug string, name string, commitHash string) error {
+	start := time.Now()
+	err := api.api.CreateBranch(repoOwner, repoSlug, name, commitHash)
+	api.observe("CreateBranch", start, err)
+	return err
+}
+
+func (api *metricsAPI) CurrentUser() (*Owner, error) {
+	start := time.Now()
+	user, err := api.api.CurrentUser()
+	api.observe("CurrentUser", start, err)
+	return user, err
+}
+
+func (api *metricsAPI) GetFileContent(repoOwner string, repoSlug string, ref string, path string) ([]byte, error) {
+	start := time.Now()
+	content, err := api.api.GetFileContent(repoOwner, repoSlug, ref, path)
+	api.observe("GetFileContent", start, err)
+	return content, err
+}
@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestCounterVecFormat(t *testing.T) {
+	counter := &CounterVec{name: "test_total", help: "Test counter.", labels: []string{"action", "stage"}, values: make(map[string]float64)}
+	counter.Inc("merged", "qa")
+	counter.Inc("created", "dev")
+	counter.Inc("created", "dev")
+	counter.Inc("created", `a"b\c`+"\nd")
+
+	var out bytes.Buffer
+	counter.write(&out)
+	want := `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{action="created",stage="a\"b\\c\nd"} 1
+test_total{action="created",stage="dev"} 2
+test_total{action="merged",stage="qa"} 1
+`
+	if out.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+func TestCounterWithoutLabelsFormat(t *testing.T) {
+	counter := &CounterVec{name: "test_total", help: "Test counter.", values: make(map[string]float64)}
+	counter.Inc()
+	counter.Inc()
+
+	var out bytes.Buffer
+	counter.write(&out)
+	want := "# HELP test_total Test counter.\n# TYPE test_total counter\ntest_total 2\n"
+	if out.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+func TestHistogramVecFormat(t *testing.T) {
+	vec := &HistogramVec{name: "test_seconds", help: "Test histogram.", labels: []string{"operation"},
+		buckets: []float64{0.5, 1, 10}, series: make(map[string]*histogram)}
+	vec.Observe(0.25, "Merge")
+	vec.Observe(1, "Merge")
+	vec.Observe(30, "Merge")
+
+	var out bytes.Buffer
+	vec.write(&out)
+	// Buckets are cumulative and bounds are inclusive
+	want := `# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{operation="Merge",le="0.5"} 1
+test_seconds_bucket{operation="Merge",le="1"} 2
+test_seconds_bucket{operation="Merge",le="10"} 2
+test_seconds_bucket{operation="Merge",le="+Inf"} 3
+test_seconds_sum{operation="Merge"} 31.25
+test_seconds_count{operation="Merge"} 3
+`
+	if out.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+func TestGaugeFuncFormat(t *testing.T) {
+	gauge := &GaugeFunc{name: "test_depth", help: "Test gauge.", value: func() float64 { return 3 }}
+
+	var out bytes.Buffer
+	gauge.write(&out)
+	want := "# HELP test_depth Test gauge.\n# TYPE test_depth gauge\ntest_depth 3\n"
+	if out.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+// sampleLine is a sample of the text exposition format: a metric name, optional labels and a value
+var sampleLine = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*(\{[a-zA-Z_][a-zA-Z0-9_]*="(?:[^"\\]|\\.)*"(?:,[a-zA-Z_][a-zA-Z0-9_]*="(?:[^"\\]|\\.)*")*\})? (?:[-+]?[0-9.eE+-]+|\+Inf|-Inf|NaN)$`)
+
+func TestMetricsHandler(t *testing.T) {
+	WebhookEvents.Inc(RepoPush)
+	DuplicateDeliveries.Inc()
+	BitbucketRequestDuration.Observe(0.2, "ListBranches")
+
+	recorder := httptest.NewRecorder()
+	MetricsHandler(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	if contentType := recorder.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", contentType)
+	}
+	body := recorder.Body.String()
+	for _, family := range []string{"cascade_webhook_events_total counter", "cascade_webhook_duplicate_deliveries_total counter",
+		"cascade_bitbucket_request_duration_seconds histogram"} {
+		if !strings.Contains(body, "# TYPE "+family+"\n") {
+			t.Errorf("no %s in\n%s", family, body)
+		}
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(body, "\n"), "\n") {
+		if !strings.HasPrefix(line, "# HELP ") && !strings.HasPrefix(line, "# TYPE ") && !sampleLine.MatchString(line) {
+			t.Errorf("invalid line %q", line)
+		}
+	}
+}
@@ -207,7 +207,11 @@ type RepoCommitStatusCreatedPayload struct {
 		Type        string    `json:"type"`
 		CreatedOn   time.Time `json:"created_on"`
 		UpdatedOn   time.Time `json:"updated_on"`
-		Links       struct {
+		Refname     string    `json:"refname"`
+		Commit      struct {
+			Hash string `json:"hash"`
+		} `json:"commit"`
+		Links struct {
 			Commit struct {
 				Href string `json:"href"`
 			} `json:"commit"`
@@ -231,7 +235,11 @@ type RepoCommitStatusUpdatedPayload struct {
 		Type        string    `json:"type"`
 		CreatedOn   time.Time `json:"created_on"`
 		UpdatedOn   time.Time `json:"updated_on"`
-		Links       struct {
+		Refname     string    `json:"refname"`
+		Commit      struct {
+			Hash string `json:"hash"`
+		} `json:"commit"`
+		Links struct {
 			Commit struct {
 				Href string `json:"href"`
 			} `json:"commit"`
@@ -443,6 +451,15 @@ type Issue struct {
 	} `json:"links"`
 }
 
+// Participant is a user taking part in the review of a pull request
+type Participant struct {
+	Type     string `json:"type"`
+	User     Owner  `json:"user"`
+	Role     string `json:"role"`
+	Approved bool   `json:"approved"`
+	State    string `json:"state"`
+}
+
 // Comment is the common Bitbucket Comment Sub Entity
 type Comment struct {
 	ID     int64 `json:"id"`
@@ -499,13 +516,13 @@ type PullRequest struct {
 	MergeCommit struct {
 		Hash string `json:"hash"`
 	} `json:"merge_commit"`
-	Participants      []Owner   `json:"participants"`
-	Reviewers         []Owner   `json:"reviewers"`
-	CloseSourceBranch bool      `json:"close_source_branch"`
-	ClosedBy          Owner     `json:"closed_by"`
-	Reason            string    `json:"reason"`
-	CreatedOn         time.Time `json:"created_on"`
-	UpdatedOn         time.Time `json:"updated_on"`
+	Participants      []Participant `json:"participants"`
+	Reviewers         []Owner       `json:"reviewers"`
+	CloseSourceBranch bool          `json:"close_source_branch"`
+	ClosedBy          Owner         `json:"closed_by"`
+	Reason            string        `json:"reason"`
+	CreatedOn         time.Time     `json:"created_on"`
+	UpdatedOn         time.Time     `json:"updated_on"`
 	Links             struct {
 		Self struct {
 			Href string `json:"href"`
@@ -518,104 +535,158 @@ type PullRequest struct {
 
 // Branches hack (Repository.Refs.Branches)
 type BranchesPayload struct {
-	Values []struct {
-		Name   string `json:"name"`
-		Target struct {
-			Type   string    `json:"type"`
-			Hash   string    `json:"hash"`
-			Date   time.Time `json:"date"`
-			Author struct {
-				Type string `json:"type"`
-				Raw  string `json:"raw"`
-				User struct {
-					DisplayName string `json:"display_name"`
-					Links       struct {
-						Self struct {
-							Href string `json:"href"`
-						} `json:"self"`
-						Avatar struct {
-							Href string `json:"href"`
-						} `json:"avatar"`
-						HTML struct {
-							Href string `json:"href"`
-						} `json:"html"`
-					} `json:"links"`
-					Type      string `json:"type"`
-					UUID      string `json:"uuid"`
-					AccountID string `json:"account_id"`
-					Nickname  string `json:"nickname"`
-				} `json:"user"`
-			} `json:"author"`
-			Message string `json:"message"`
-			Links   struct {
-				Self struct {
-					Href string `json:"href"`
-				} `json:"self"`
-				HTML struct {
-					Href string `json:"href"`
-				} `json:"html"`
-				Diff struct {
-					Href string `json:"href"`
-				} `json:"diff"`
-				Approve struct {
-					Href string `json:"href"`
-				} `json:"approve"`
-				Comments struct {
-					Href string `json:"href"`
-				} `json:"comments"`
-				Statuses struct {
-					Href string `json:"href"`
-				} `json:"statuses"`
-				Patch struct {
-					Href string `json:"href"`
-				} `json:"patch"`
-			} `json:"links"`
-			Parents []struct {
-				Type  string `json:"type"`
-				Hash  string `json:"hash"`
-				Links struct {
+	Values  []BranchRef `json:"values"`
+	Pagelen int         `json:"pagelen"`
+	Size    int         `json:"size"`
+	Page    int         `json:"page"`
+	Next    string      `json:"next"`
+}
+
+// BranchRef is a branch as listed by Repository.Refs.Branches
+type BranchRef struct {
+	Name   string `json:"name"`
+	Target struct {
+		Type   string    `json:"type"`
+		Hash   string    `json:"hash"`
+		Date   time.Time `json:"date"`
+		Author struct {
+			Type string `json:"type"`
+			Raw  string `json:"raw"`
+			User struct {
+				DisplayName string `json:"display_name"`
+				Links       struct {
 					Self struct {
 						Href string `json:"href"`
 					} `json:"self"`
-					HTML struct {
-						Href string `json:"href"`
-					} `json:"html"`
-				} `json:"links"`
-			} `json:"parents"`
-			Repository struct {
-				Type     string `json:"type"`
-				FullName string `json:"full_name"`
-				Links    struct {
-					Self struct {
+					Avatar struct {
 						Href string `json:"href"`
-					} `json:"self"`
+					} `json:"avatar"`
 					HTML struct {
 						Href string `json:"href"`
 					} `json:"html"`
-					Avatar struct {
-						Href string `json:"href"`
-					} `json:"avatar"`
 				} `json:"links"`
-				Name string `json:"name"`
-				UUID string `json:"uuid"`
-			} `json:"repository"`
-		} `json:"target"`
-		Links struct {
+				Type      string `json:"type"`
+				UUID      string `json:"uuid"`
+				AccountID string `json:"account_id"`
+				Nickname  string `json:"nickname"`
+			} `json:"user"`
+		} `json:"author"`
+		Message string `json:"message"`
+		Links   struct {
 			Self struct {
 				Href string `json:"href"`
 			} `json:"self"`
-			Commits struct {
-				Href string `json:"href"`
-			} `json:"commits"`
 			HTML struct {
 				Href string `json:"href"`
 			} `json:"html"`
+			Diff struct {
+				Href string `json:"href"`
+			} `json:"diff"`
+			Approve struct {
+				Href string `json:"href"`
+			} `json:"approve"`
+			Comments struct {
+				Href string `json:"href"`
+			} `json:"comments"`
+			Statuses struct {
+				Href string `json:"href"`
+			} `json:"statuses"`
+			Patch struct {
+				Href string `json:"href"`
+			} `json:"patch"`
 		} `json:"links"`
-		Type                 string   `json:"type"`
-		MergeStrategies      []string `json:"merge_strategies"`
-		DefaultMergeStrategy string   `json:"default_merge_strategy"`
-	} `json:"values"`
-	Pagelen int `json:"pagelen"`
-	Size    int `json:"size"`
-	Page    int `json:"page"`
+		Parents []struct {
+			Type  string `json:"type"`
+			Hash  string `json:"hash"`
+			Links struct {
+				Self struct {
+					Href string `json:"href"`
+				} `json:"self"`
+				HTML struct {
+					Href string `json:"href"`
+				} `json:"html"`
+			} `json:"links"`
+		} `json:"parents"`
+		Repository struct {
+			Type     string `json:"type"`
+			FullName string `json:"full_name"`
+			Links    struct {
+				Self struct {
+					Href string `json:"href"`
+				} `json:"self"`
+				HTML struct {
+					Href string `json:"href"`
+				} `json:"html"`
+				Avatar struct {
+					Href string `json:"href"`
+				} `json:"avatar"`
+			} `json:"links"`
+			Name string `json:"name"`
+			UUID string `json:"uuid"`
+		} `json:"repository"`
+	} `json:"target"`
+	Links struct {
+		Self struct {
+			Href string `json:"href"`
+		} `json:"self"`
+		Commits struct {
+			Href string `json:"href"`
+		} `json:"commits"`
+		HTML struct {
+			Href string `json:"href"`
+		} `json:"html"`
+	} `json:"links"`
+	Type                 string   `json:"type"`
+	MergeStrategies      []string `json:"merge_strategies"`
+	DefaultMergeStrategy string   `json:"default_merge_strategy"`
+}
+
+// CommitStatus is a build status reported against a commit
+type CommitStatus struct {
+	Key         string    `json:"key"`
+	Name        string    `json:"name"`
+	State       string    `json:"state"`
+	Description string    `json:"description"`
+	URL         string    `json:"url"`
+	CreatedOn   time.Time `json:"created_on"`
+	UpdatedOn   time.Time `json:"updated_on"`
+}
+
+// Commit is an entry of the repository commits listing
+type Commit struct {
+	Hash    string    `json:"hash"`
+	Message string    `json:"message"`
+	Date    time.Time `json:"date"`
+	Author  struct {
+		Raw  string `json:"raw"`
+		User Owner  `json:"user"`
+	} `json:"author"`
+	Parents []struct {
+		Hash string `json:"hash"`
+	} `json:"parents"`
+}
+
+// DiffStat is a file changed by a pull request. Status is one of added, removed, modified, renamed,
+// or for conflicts merge conflict, rename conflict, rename/deleted, local deleted or remote deleted.
+type DiffStat struct {
+	Status       string `json:"status"`
+	LinesAdded   int    `json:"lines_added"`
+	LinesRemoved int    `json:"lines_removed"`
+	Old          *struct {
+		Path string `json:"path"`
+	} `json:"old"`
+	New *struct {
+		Path string `json:"path"`
+	} `json:"new"`
+}
+
+// Path returns the new path of the file, or the old one when it was removed
+func (diffStat DiffStat) Path() string {
+	if diffStat.New != nil {
+		return diffStat.New.Path
+	}
+	if diffStat.Old != nil {
+		return diffStat.Old.Path
+	}
+	return ""
 }
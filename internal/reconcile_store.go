@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DeclinedCascade is an #AutoCascade pull request declined by a human, the drift check leaves its
+// branches alone until the source branch moves on
+type DeclinedCascade struct {
+	Repository    string `json:"repository"`
+	PullRequestID int64  `json:"pull_request_id"`
+	Source        string `json:"source"`
+	Destination   string `json:"destination"`
+	// CommitHash is the source commit the pull request was declined at
+	CommitHash string    `json:"commit_hash"`
+	DeclinedAt time.Time `json:"declined_at"`
+}
+
+// ReconcileStore keeps what the Reconciler needs across restarts, the repositories webhooks came from
+// and the declined cascades. It is saved to a file.
+type ReconcileStore struct {
+	path string
+
+	mu    sync.Mutex
+	state reconcileState
+}
+
+type reconcileState struct {
+	// Repositories are keyed by lowercased full name
+	Repositories map[string]Repository       `json:"repositories"`
+	Declined     map[string]*DeclinedCascade `json:"declined"`
+}
+
+func NewReconcileStore(path string) (*ReconcileStore, error) {
+	store := &ReconcileStore{path: path}
+
+	buf, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(buf, &store.state); err != nil {
+			log.Println("ReconcileStore -> ignoring unreadable file: ", path, err)
+			store.state = reconcileState{}
+		}
+	}
+	if store.state.Repositories == nil {
+		store.state.Repositories = make(map[string]Repository)
+	}
+	if store.state.Declined == nil {
+		store.state.Declined = make(map[string]*DeclinedCascade)
+	}
+	return store, nil
+}
+
+// AddRepository remembers a repository, only saving when it is new
+func (store *ReconcileStore) AddRepository(repository Repository) {
+	if repository.FullName == "" {
+		return
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	key := strings.ToLower(repository.FullName)
+	if _, ok := store.state.Repositories[key]; ok {
+		return
+	}
+	store.state.Repositories[key] = repository
+	store.save()
+}
+
+// Repositories returns the remembered repositories by full name
+func (store *ReconcileStore) Repositories() []Repository {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	repositories := make([]Repository, 0, len(store.state.Repositories))
+	for _, repository := range store.state.Repositories {
+		repositories = append(repositories, repository)
+	}
+	sort.Slice(repositories, func(i, j int) bool {
+		return repositories[i].FullName < repositories[j].FullName
+	})
+	return repositories
+}
+
+// PutDeclined records a declined cascade pull request, replacing the previous one between its branches
+func (store *ReconcileStore) PutDeclined(declined *DeclinedCascade) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.state.Declined[declinedKey(declined.Repository, declined.Source, declined.Destination)] = declined
+	store.save()
+}
+
+// Declined returns the last declined cascade pull request from source into destination, nil when none
+func (store *ReconcileStore) Declined(repository string, source string, destination string) *DeclinedCascade {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	return store.state.Declined[declinedKey(repository, source, destination)]
+}
+
+// save is best effort, losing it only means a declined pull request may be reopened once
+func (store *ReconcileStore) save() {
+	buf, err := json.Marshal(store.state)
+	if err == nil {
+		err = writeFileAtomic(store.path, buf)
+	}
+	if err != nil {
+		log.Println("ReconcileStore -> could not save: ", err)
+	}
+}
+
+func declinedKey(repository string, source string, destination string) string {
+	return strings.ToLower(repository) + ":" + source + "->" + destination
+}
@@ -0,0 +1,273 @@
+package internal
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReconcileEvent is the event key of the jobs queued by the Reconciler
+const ReconcileEvent = "cascade:reconcile"
+
+// Reconciler periodically queues a reconcile job for every known repository, catching up on the
+// pull requests whose webhooks were missed or arrived before their builds passed, and on the
+// cascades lost to dropped webhooks or crashes
+type Reconciler struct {
+	service  *BitbucketService
+	jobQueue *JobQueue
+	interval time.Duration
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewReconciler(service *BitbucketService, jobQueue *JobQueue, interval time.Duration) *Reconciler {
+	return &Reconciler{
+		service:  service,
+		jobQueue: jobQueue,
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start queues the reconcile jobs every interval until Stop, a zero interval disables it
+func (reconciler *Reconciler) Start() {
+	if reconciler.interval <= 0 {
+		close(reconciler.done)
+		return
+	}
+	go func() {
+		defer close(reconciler.done)
+		ticker := time.NewTicker(reconciler.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-reconciler.stop:
+				return
+			case <-ticker.C:
+				reconciler.QueueAll()
+			}
+		}
+	}()
+}
+
+func (reconciler *Reconciler) Stop() {
+	close(reconciler.stop)
+	<-reconciler.done
+}
+
+// QueueAll queues a reconcile job per known repository, skipping the repositories whose previous job
+// is still queued or waiting to be retried so an outage doesn't pile them up
+func (reconciler *Reconciler) QueueAll() {
+	pending, err := reconciler.jobQueue.Pending(ReconcileEvent)
+	if err != nil {
+		log.Println("Could not list pending reconcile jobs: ", err)
+		return
+	}
+	queued := make(map[string]bool, len(pending))
+	for _, job := range pending {
+		var payload PullRequestMergedPayload
+		if err := json.Unmarshal(job.Payload, &payload); err == nil {
+			queued[strings.ToLower(payload.Repository.FullName)] = true
+		}
+	}
+
+	for _, repository := range reconciler.service.KnownRepositories() {
+		if queued[strings.ToLower(repository.FullName)] {
+			log.Println("SKIP reconcile (previous one pending) -> ", repository.FullName)
+			continue
+		}
+		var payload PullRequestMergedPayload
+		payload.Repository = repository
+		buf, err := json.Marshal(payload)
+		if err == nil {
+			_, err = reconciler.jobQueue.Enqueue(ReconcileEvent, buf)
+		}
+		if err != nil {
+			log.Println("Could not queue reconcile of ", repository.FullName, ": ", err)
+		}
+	}
+}
+
+// RememberRepository adds the repository of a webhook to the ones the Reconciler sweeps, across restarts
+func (service *BitbucketService) RememberRepository(repository Repository) {
+	if service.plan == nil {
+		service.reconcile.AddRepository(repository)
+	}
+}
+
+// KnownRepositories returns the configured repositories and those webhooks came from, by full name
+func (service *BitbucketService) KnownRepositories() []Repository {
+	byName := make(map[string]Repository)
+	for _, fullName := range service.Registry.Repositories() {
+		parts := strings.SplitN(fullName, "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		var repository Repository
+		repository.FullName = fullName
+		repository.Name = parts[1]
+		repository.Owner.Username = parts[0]
+		repository.Owner.UUID = parts[0]
+		byName[strings.ToLower(fullName)] = repository
+	}
+	//Webhook payloads carry the owner UUID, they win over the configured names
+	for _, repository := range service.reconcile.Repositories() {
+		byName[strings.ToLower(repository.FullName)] = repository
+	}
+
+	repositories := make([]Repository, 0, len(byName))
+	for _, repository := range byName {
+		repositories = append(repositories, repository)
+	}
+	sort.Slice(repositories, func(i, j int) bool {
+		return repositories[i].FullName < repositories[j].FullName
+	})
+	return repositories
+}
+
+/*** RECONCILE -> SWEEP OPEN PRs & REPAIR DRIFT ***/
+/* ============================================== */
+
+// Reconcile approves and merges every open #AutoCascade pull request of the repository that is ready,
+// then opens the #AutoCascade pull requests missing between stages
+func (service *BitbucketService) Reconcile(repository *Repository) error {
+	log.Println("--------- START Reconcile ---------", repository.FullName)
+
+	settings := service.Registry.For(repository.FullName)
+	if settings.DryRun && service.plan == nil {
+		_, err := service.runPlanned(repository.FullName, "", func(dry *BitbucketService) error {
+			return dry.Reconcile(repository)
+		})
+		return err
+	}
+
+	var err error
+	if settings.AutoMerge {
+		err = service.DoApproveAndMerge(settings, repository.Owner.UUID, repository.Name)
+	} else {
+		log.Println("SKIP Auto Merge (disabled for repository) -> ", repository.FullName)
+	}
+	if driftErr := service.RepairDrift(settings, repository); err == nil {
+		err = driftErr
+	}
+
+	log.Println("--------- End Reconcile ---------")
+	return err
+}
+
+// BranchDrift is a stage branch holding commits its next stage branch lacks
+type BranchDrift struct {
+	Upstream   string `json:"upstream"`
+	Downstream string `json:"downstream"`
+	Missing    int    `json:"missing"`
+	// Commits are the newest missing commits, at most maxDriftCommits
+	Commits []string `json:"commits"`
+	// Skipped is why no pull request was opened for the drift, empty when one was
+	Skipped string `json:"skipped,omitempty"`
+}
+
+// DriftReport is the outcome of the last drift check of a repository
+type DriftReport struct {
+	Repository string        `json:"repository"`
+	CheckedAt  time.Time     `json:"checked_at"`
+	Drift      []BranchDrift `json:"drift"`
+	Error      string        `json:"error,omitempty"`
+}
+
+const maxDriftCommits = 10
+
+// RepairDrift compares every stage branch with the branches it cascades into and opens the
+// #AutoCascade pull requests for the ones missing commits. Drift into a branch the bot may not approve
+// and merge is expected, humans promote those stages, and a declined cascade stays declined until its
+// source branch moves on: both are only reported.
+func (service *BitbucketService) RepairDrift(settings *RepositorySettings, repository *Repository) error {
+	log.Println("--------- START RepairDrift ---------")
+
+	repoOwner := repository.Owner.UUID
+	repoName := repository.Name
+	report := &DriftReport{Repository: repository.FullName, CheckedAt: time.Now(), Drift: []BranchDrift{}}
+	defer service.driftReports.Put(report)
+
+	targets, err := service.GetBranches(settings, repoName, repoOwner)
+	if err != nil {
+		report.Error = err.Error()
+		return err
+	}
+
+	var firstErr error
+	for _, upstreamBranch := range targets {
+		upstream := upstreamBranch.Name
+		for _, downstream := range service.NextTargets(settings, upstreamBranch, targets) {
+
+			commits, err := service.bitbucketAPI.ListCommits(repoOwner, repoName, upstream, downstream)
+			if err == nil && len(commits) > 0 {
+				drift := BranchDrift{Upstream: upstream, Downstream: downstream, Missing: len(commits)}
+				for i := 0; i < len(commits) && i < maxDriftCommits; i++ {
+					drift.Commits = append(drift.Commits, commits[i].Hash)
+				}
+				log.Println("Drift -> ", upstream, " has ", len(commits), " commits missing from ", downstream)
+
+				if declined := service.reconcile.Declined(repository.FullName, upstream, downstream); declined != nil && sameCommit(declined.CommitHash, upstreamBranch.Hash) {
+					drift.Skipped = "declined #" + strconv.FormatInt(declined.PullRequestID, 10)
+				} else if !settings.Policy.CanApprove(downstream) || !settings.Policy.CanMerge(downstream) {
+					drift.Skipped = "merged by hand"
+				} else {
+					err = service.CreatePullRequest(settings, "Missed cascade "+upstream+" -> "+downstream, upstream, downstream, repoName, repoOwner, CascadeOrigin{})
+				}
+				report.Drift = append(report.Drift, drift)
+			}
+			if err != nil {
+				log.Println("err: ", err)
+				if firstErr == nil {
+					firstErr = err
+					report.Error = err.Error()
+				}
+			}
+		}
+	}
+
+	log.Println("--------- End RepairDrift ---------")
+	return firstErr
+}
+
+// driftReports keeps the last DriftReport per repository for the /drift endpoint
+type driftReports struct {
+	mu      sync.Mutex
+	reports map[string]*DriftReport
+}
+
+func newDriftReports() *driftReports {
+	return &driftReports{reports: make(map[string]*DriftReport)}
+}
+
+func (reports *driftReports) Put(report *DriftReport) {
+	reports.mu.Lock()
+	defer reports.mu.Unlock()
+
+	reports.reports[strings.ToLower(report.Repository)] = report
+}
+
+func (reports *driftReports) List() []*DriftReport {
+	reports.mu.Lock()
+	defer reports.mu.Unlock()
+
+	list := make([]*DriftReport, 0, len(reports.reports))
+	for _, report := range reports.reports {
+		list = append(list, report)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Repository < list[j].Repository
+	})
+	return list
+}
+
+// DriftReports returns the last drift check of every reconciled repository
+func (service *BitbucketService) DriftReports() []*DriftReport {
+	return service.driftReports.List()
+}
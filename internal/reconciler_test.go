@@ -0,0 +1,132 @@
+package internal
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testRepository is the repository of the test service
+func testRepository() *Repository {
+	return &testPayload(PullRequest{}).Repository
+}
+
+// pullRequestsInto returns the pull requests into dest, in creation order
+func pullRequestsInto(fake *FakeBitbucket, dest string) []PullRequest {
+	var prs []PullRequest
+	for _, pr := range fake.PullRequests(testOwner, testSlug) {
+		if pr.Destination.Branch.Name == dest {
+			prs = append(prs, pr)
+		}
+	}
+	return prs
+}
+
+func TestRepairDriftOnlyOpensAutomaticStages(t *testing.T) {
+	service, fake := newTestService(t, nil)
+	// qa/acme is ahead of uat/acme, which is approved and merged by hand
+	fake.AddCommit(testOwner, testSlug, "qa/acme", "qa1", "Fix on qa")
+	settings := service.Registry.For("workspace/repo")
+
+	if err := service.RepairDrift(settings, testRepository()); err != nil {
+		t.Fatal(err)
+	}
+
+	open := openCascades(fake)
+	if _, ok := open["dev/acme"]; !ok {
+		t.Errorf("open pull requests = %v, want one into dev/acme", open)
+	}
+	if _, ok := open["uat/acme"]; ok {
+		t.Error("drift repaired into uat/acme")
+	}
+
+	skipped := make(map[string]string)
+	for _, drift := range service.DriftReports()[0].Drift {
+		skipped[drift.Upstream+" -> "+drift.Downstream] = drift.Skipped
+	}
+	if reason, ok := skipped["qa/acme -> uat/acme"]; !ok || reason != "merged by hand" {
+		t.Errorf("drift = %v, want qa/acme -> uat/acme reported as merged by hand", skipped)
+	}
+	if reason := skipped["develop -> dev/acme"]; reason != "" {
+		t.Errorf("develop -> dev/acme skipped: %s", reason)
+	}
+}
+
+func TestRepairDriftLeavesDeclinedCascades(t *testing.T) {
+	service, fake := newTestService(t, nil)
+	settings := service.Registry.For("workspace/repo")
+	if err := service.RepairDrift(settings, testRepository()); err != nil {
+		t.Fatal(err)
+	}
+	pr := openCascades(fake)["dev/acme"]
+
+	// A human declines the missed cascade
+	if err := fake.DeclinePullRequest(testOwner, testSlug, pr.ID); err != nil {
+		t.Fatal(err)
+	}
+	declined := pullRequestsInto(fake, "dev/acme")[0]
+	service.TrackPullRequest(testPayload(declined))
+
+	if err := service.RepairDrift(settings, testRepository()); err != nil {
+		t.Fatal(err)
+	}
+	if prs := pullRequestsInto(fake, "dev/acme"); len(prs) != 1 {
+		t.Fatalf("pull requests into dev/acme = %d, want the declined one only", len(prs))
+	}
+
+	// New commits are a new drift
+	fake.AddCommit(testOwner, testSlug, "develop", "feature2", "Another feature")
+	if err := service.RepairDrift(settings, testRepository()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := openCascades(fake)["dev/acme"]; !ok {
+		t.Error("drift after new commits not repaired")
+	}
+}
+
+func TestQueueAllSkipsPendingReconciles(t *testing.T) {
+	service, _ := newTestService(t, nil)
+	service.RememberRepository(*testRepository())
+	queue, err := NewJobQueue(t.TempDir(), 1, 3, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Stop(time.Second)
+
+	// Not started, as if the first reconcile were stuck behind a Bitbucket outage
+	reconciler := NewReconciler(service, queue, time.Minute)
+	reconciler.QueueAll()
+	reconciler.QueueAll()
+
+	pending, err := queue.Pending(ReconcileEvent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 {
+		t.Errorf("pending reconcile jobs = %d, want 1", len(pending))
+	}
+}
+
+func TestReconcileStoreSurvivesRestarts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reconcile.json")
+	store, err := NewReconcileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.AddRepository(*testRepository())
+	store.PutDeclined(&DeclinedCascade{Repository: "workspace/repo", PullRequestID: 7, Source: "develop", Destination: "dev/acme", CommitHash: "feature1"})
+
+	restarted, err := NewReconcileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repositories := restarted.Repositories(); len(repositories) != 1 || repositories[0].FullName != "workspace/repo" {
+		t.Errorf("repositories = %+v, want workspace/repo", repositories)
+	}
+	if declined := restarted.Declined("Workspace/Repo", "develop", "dev/acme"); declined == nil || declined.PullRequestID != 7 {
+		t.Errorf("declined = %+v, want #7", declined)
+	}
+	if declined := restarted.Declined("workspace/repo", "develop", "dev/globex"); declined != nil {
+		t.Errorf("declined into dev/globex = %+v, want none", declined)
+	}
+}
@@ -0,0 +1,81 @@
+package internal
+
+import (
+	"log"
+	"strings"
+
+	"golang.org/x/mod/semver"
+)
+
+/*** RELEASE TRAIN -> NEXT NEWER RELEASE ***/
+/* ======================================= */
+
+// releaseVersion returns the semantic version ("v" prefixed) and site of a release branch. The version
+// is the version group of the branch grammar, or the name after the release prefix, e.g. "v2020.12.0"
+// for release/2020.12.0. ok is false for branches that aren't releases or have no valid version.
+func (settings *RepositorySettings) releaseVersion(branch Branch) (version string, site string, ok bool) {
+	if !strings.HasPrefix(branch.Name, settings.ReleaseBranchPrefix) {
+		return "", "", false
+	}
+	version = branch.Version
+	if version != "" {
+		site = branch.Site
+	} else {
+		//The grammar couldn't split it, the whole name is the version
+		version = strings.TrimPrefix(branch.Name, settings.ReleaseBranchPrefix)
+	}
+	if !strings.HasPrefix(version, "v") {
+		version = "v" + version
+	}
+	return version, site, semver.IsValid(version)
+}
+
+// ReleaseTrainNextTarget returns the release branch following oldDest in semver order on the same site,
+// or the development branch when oldDest is the newest release. Merges are carried forward one release
+// at a time, like Bitbucket Server's automatic branch merging.
+func (service *BitbucketService) ReleaseTrainNextTarget(settings *RepositorySettings, oldDest Branch, targets []Branch) string {
+	log.Println("--------- START ReleaseTrainNextTarget ---------")
+
+	destVersion, destSite, ok := settings.releaseVersion(oldDest)
+	if !ok {
+		log.Println("SKIP release train (no semantic version) -> ", oldDest.Name)
+		return ""
+	}
+
+	next := ""
+	nextVersion := ""
+	for _, target := range targets {
+		version, site, ok := settings.releaseVersion(target)
+		if !ok || site != destSite || semver.Compare(destVersion, version) >= 0 {
+			continue
+		}
+		if next == "" || semver.Compare(version, nextVersion) < 0 {
+			next, nextVersion = target.Name, version
+		}
+	}
+	if next == "" {
+		next = settings.DevelopmentBranchName
+	}
+
+	if !settings.Policy.CanTarget(next) {
+		log.Println("PROTECTED SKIPPED -> ", next)
+		if service.plan == nil {
+			CascadePullRequests.Inc("skipped", settings.stageName(next))
+		}
+		return ""
+	}
+
+	log.Println("Next Target: ", oldDest.Name, " -> ", next)
+	log.Println("--------- End ReleaseTrainNextTarget ---------")
+	return next
+}
+
+// branchNameFilter narrows branch listings to the stage branches, and the release branches for the
+// release train
+func (settings *RepositorySettings) branchNameFilter() []string {
+	filter := settings.Pipeline.NameFilter()
+	if filter != nil && settings.ReleaseTrain && !containsString(filter, settings.ReleaseBranchPrefix) {
+		filter = append(filter, settings.ReleaseBranchPrefix)
+	}
+	return filter
+}
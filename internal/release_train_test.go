@@ -0,0 +1,55 @@
+package internal
+
+import "testing"
+
+func TestReleaseTrainNextTarget(t *testing.T) {
+	settings := testSettings(t)
+	service := &BitbucketService{}
+	var targets []Branch
+	for _, name := range []string{"release/1.10.0", "release/1.2.0", "release/1.9.0", "release/1.10.0-rc1",
+		"release/acme_2.0.0", "release/acme_1.5.0", "release/next", "qa/acme", "develop"} {
+		targets = append(targets, settings.ParseBranch(name))
+	}
+
+	tests := []struct {
+		dest string
+		want string
+	}{
+		{dest: "release/1.2.0", want: "release/1.9.0"},
+		// 1.10 is newer than 1.9, not older like the names sort
+		{dest: "release/1.9.0", want: "release/1.10.0-rc1"},
+		{dest: "release/1.10.0-rc1", want: "release/1.10.0"},
+		{dest: "release/1.10.0", want: "develop"},
+		{dest: "release/1.2", want: "release/1.9.0"},
+		// Releases of a site only cascade into releases of the same site
+		{dest: "release/acme_1.5.0", want: "release/acme_2.0.0"},
+		{dest: "release/acme_2.0.0", want: "develop"},
+		{dest: "release/next", want: ""},
+		{dest: "qa/acme", want: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.dest, func(t *testing.T) {
+			if got := service.ReleaseTrainNextTarget(settings, settings.ParseBranch(test.dest), targets); got != test.want {
+				t.Errorf("ReleaseTrainNextTarget(%q) = %q, want %q", test.dest, got, test.want)
+			}
+		})
+	}
+}
+
+func TestReleaseTrainStopsAtProtectedBranches(t *testing.T) {
+	settings := *testSettings(t)
+	policy, err := NewBranchPolicy(PolicyConfig{NeverTarget: []string{"develop"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings.Policy = policy
+	service := &BitbucketService{}
+	targets := []Branch{settings.ParseBranch("release/1.0.0"), settings.ParseBranch("release/2.0.0")}
+
+	if got := service.ReleaseTrainNextTarget(&settings, targets[0], targets); got != "release/2.0.0" {
+		t.Errorf("ReleaseTrainNextTarget(release/1.0.0) = %q, want release/2.0.0", got)
+	}
+	if got := service.ReleaseTrainNextTarget(&settings, targets[1], targets); got != "" {
+		t.Errorf("ReleaseTrainNextTarget(release/2.0.0) = %q, want none", got)
+	}
+}
@@ -0,0 +1,244 @@
+package internal
+
+import (
+	"log"
+	"math/rand"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RetryTransport is the http.RoundTripper shared by every outbound Bitbucket call. It waits for
+// the workspace's request budget before each attempt and retries 429 responses, and 5xx responses
+// and connection errors of idempotent requests, honouring Retry-After or else backing off
+// exponentially with jitter. A POST answered with a 5xx may have been applied, so it is only retried
+// when it never left. The last response is returned as is, so callers turn it into an UpstreamError.
+type RetryTransport struct {
+	Base       http.RoundTripper
+	Budget     *RequestBudget
+	MaxRetries int
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+}
+
+func NewRetryTransport(base http.RoundTripper, budget *RequestBudget, maxRetries int) *RetryTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &RetryTransport{
+		Base:       base,
+		Budget:     budget,
+		MaxRetries: maxRetries,
+		BaseDelay:  time.Second,
+		MaxDelay:   time.Minute,
+	}
+}
+
+func (transport *RetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	workspace := workspaceOf(req)
+
+	for attempt := 0; ; attempt++ {
+		if transport.Budget != nil {
+			if err := transport.Budget.Wait(req, workspace); err != nil {
+				return nil, err
+			}
+		}
+
+		if attempt > 0 && req.Body != nil {
+			// The previous attempt consumed the body, RoundTrippers must not modify the caller's request
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+
+		// Whether the request reached the wire decides if a failed POST is safe to send again
+		var sent int32
+		trace := &httptrace.ClientTrace{WroteRequest: func(httptrace.WroteRequestInfo) {
+			atomic.StoreInt32(&sent, 1)
+		}}
+		response, err := transport.Base.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+		if !transport.shouldRetry(req, response, err, attempt, atomic.LoadInt32(&sent) == 1) {
+			return response, err
+		}
+
+		delay := transport.delay(response, attempt)
+		if err != nil {
+			log.Println("Bitbucket request failed, retrying in ", delay, ": ", req.Method, req.URL.Path, err)
+		} else {
+			log.Println("Bitbucket responded ", response.Status, ", retrying in ", delay, ": ", req.Method, req.URL.Path)
+			response.Body.Close()
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// shouldRetry decides on a failed attempt, sent is whether the request was written before it failed
+func (transport *RetryTransport) shouldRetry(req *http.Request, response *http.Response, err error, attempt int, sent bool) bool {
+	if attempt >= transport.MaxRetries {
+		return false
+	}
+	// A body that can't be replayed can't be retried
+	if req.Body != nil && req.GetBody == nil {
+		return false
+	}
+	if err != nil {
+		return req.Context().Err() == nil && (idempotent(req.Method) || !sent)
+	}
+	// 429 is rejected before anything is applied
+	if response.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+	return response.StatusCode >= 500 && idempotent(req.Method)
+}
+
+// idempotent reports whether sending a request twice has the same effect as sending it once, e.g. a
+// repeated POST could comment twice or open a second pull request
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// delay prefers the server's Retry-After, otherwise doubles BaseDelay per attempt with full jitter
+func (transport *RetryTransport) delay(response *http.Response, attempt int) time.Duration {
+	if response != nil {
+		if retryAfter, ok := parseRetryAfter(response.Header.Get("Retry-After")); ok {
+			if retryAfter > transport.MaxDelay {
+				return transport.MaxDelay
+			}
+			return retryAfter
+		}
+	}
+
+	backoff := transport.BaseDelay << uint(attempt)
+	if backoff <= 0 || backoff > transport.MaxDelay {
+		backoff = transport.MaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(backoff))) + time.Millisecond
+}
+
+// parseRetryAfter accepts both the delay-seconds and HTTP-date forms
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(at); wait > 0 {
+			return wait, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// workspaceOf extracts {workspace} from .../repositories/{workspace}/..., empty for other endpoints
+func workspaceOf(req *http.Request) string {
+	parts := strings.Split(req.URL.Path, "/")
+	for i, part := range parts {
+		if part == "repositories" && i+1 < len(parts) {
+			return parts[i+1]
+		}
+	}
+	return ""
+}
+
+// RequestBudget is a token bucket per workspace, refilled at limit requests per hour. Bitbucket
+// Cloud rate limits per hour, so spreading the budget keeps bursts of cascades under the limit.
+// With a configured workspace every request, by slug, by owner UUID or outside /repositories,
+// spends the one budget of that workspace.
+type RequestBudget struct {
+	limit     int
+	workspace string
+
+	mu      sync.Mutex
+	buckets map[string]*budgetBucket
+}
+
+type budgetBucket struct {
+	tokens   float64
+	updateAt time.Time
+}
+
+func NewRequestBudget(limitPerHour int, workspace string) *RequestBudget {
+	return &RequestBudget{
+		limit:     limitPerHour,
+		workspace: workspace,
+		buckets:   make(map[string]*budgetBucket),
+	}
+}
+
+// bucketKey returns the bucket of a workspace, UUIDs with or without braces and any case share one
+func (budget *RequestBudget) bucketKey(workspace string) string {
+	if budget.workspace != "" {
+		workspace = budget.workspace
+	}
+	return strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(workspace, "{"), "}"))
+}
+
+// Wait blocks until the workspace has a request left or the request is cancelled
+func (budget *RequestBudget) Wait(req *http.Request, workspace string) error {
+	if budget.limit <= 0 {
+		return nil
+	}
+	workspace = budget.bucketKey(workspace)
+	for {
+		wait := budget.take(workspace)
+		if wait == 0 {
+			return nil
+		}
+		log.Println("Request budget exhausted for workspace ", workspace, ", waiting ", wait)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// take spends a token and returns 0, or returns how long until the next token
+func (budget *RequestBudget) take(workspace string) time.Duration {
+	budget.mu.Lock()
+	defer budget.mu.Unlock()
+
+	now := time.Now()
+	bucket, ok := budget.buckets[workspace]
+	if !ok {
+		bucket = &budgetBucket{tokens: float64(budget.limit), updateAt: now}
+		budget.buckets[workspace] = bucket
+	}
+
+	perToken := time.Hour / time.Duration(budget.limit)
+	bucket.tokens += float64(now.Sub(bucket.updateAt)) / float64(perToken)
+	if bucket.tokens > float64(budget.limit) {
+		bucket.tokens = float64(budget.limit)
+	}
+	bucket.updateAt = now
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return 0
+	}
+	return time.Duration((1 - bucket.tokens) * float64(perToken))
+}
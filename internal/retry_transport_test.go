@@ -0,0 +1,140 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryTransport(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		status   int
+		attempts int32
+	}{
+		{"GET retried on 5xx", http.MethodGet, http.StatusServiceUnavailable, 3},
+		{"PUT retried on 5xx", http.MethodPut, http.StatusBadGateway, 3},
+		{"DELETE retried on 5xx", http.MethodDelete, http.StatusInternalServerError, 3},
+		{"POST not retried on 5xx", http.MethodPost, http.StatusServiceUnavailable, 1},
+		{"POST retried on 429", http.MethodPost, http.StatusTooManyRequests, 3},
+		{"GET not retried on 4xx", http.MethodGet, http.StatusNotFound, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var attempts int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&attempts, 1)
+				w.WriteHeader(test.status)
+			}))
+			defer server.Close()
+
+			client := &http.Client{Transport: &RetryTransport{Base: http.DefaultTransport, MaxRetries: 2, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}}
+			request, _ := http.NewRequest(test.method, server.URL, strings.NewReader(`{}`))
+			response, err := client.Do(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response.Body.Close()
+			if response.StatusCode != test.status {
+				t.Errorf("status = %d, want %d", response.StatusCode, test.status)
+			}
+			if attempts != test.attempts {
+				t.Errorf("attempts = %d, want %d", attempts, test.attempts)
+			}
+		})
+	}
+}
+
+func TestRetryTransportRetriesUnsentPost(t *testing.T) {
+	//Nothing listens any more, the connection is refused before the request is written
+	server := httptest.NewServer(http.NotFoundHandler())
+	url := server.URL
+	server.Close()
+
+	var attempts int32
+	base := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&attempts, 1)
+		return http.DefaultTransport.RoundTrip(req)
+	})
+	client := &http.Client{Transport: &RetryTransport{Base: base, MaxRetries: 2, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}}
+	request, _ := http.NewRequest(http.MethodPost, url, strings.NewReader(`{}`))
+	if _, err := client.Do(request); err == nil {
+		t.Fatal("request to a closed server succeeded")
+	}
+	if attempts != 3 {
+		t.Errorf("attempts = %d, want 3", attempts)
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestRequestBudgetSharesTheConfiguredWorkspace(t *testing.T) {
+	var sent []string
+	base := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		sent = append(sent, req.URL.Path)
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+	})
+	client := &http.Client{Transport: &RetryTransport{Base: base, Budget: NewRequestBudget(3, "acme")}}
+
+	// go-bitbucket names the workspace by owner UUID, the hand-rolled calls by slug
+	for i, url := range []string{
+		"https://api.bitbucket.org/2.0/repositories/acme/repo/refs/branches",
+		"https://api.bitbucket.org/2.0/repositories/%7B0f3e5f1c-0000-4000-8000-000000000000%7D/repo/pullrequests",
+		"https://api.bitbucket.org/2.0/user",
+		"https://api.bitbucket.org/2.0/repositories/acme/repo/pullrequests/1/merge",
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		request, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		response, err := client.Do(request)
+		cancel()
+		if err == nil {
+			response.Body.Close()
+		}
+		if i < 3 && err != nil {
+			t.Fatalf("request %d = %v", i, err)
+		}
+		if i == 3 && !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("request over the budget = %v, want it to wait", err)
+		}
+	}
+	if len(sent) != 3 {
+		t.Errorf("sent %d requests, want the 3 of the budget", len(sent))
+	}
+}
+
+func TestRequestBudget(t *testing.T) {
+	budget := NewRequestBudget(2, "")
+
+	for i, workspace := range []string{"{ABC}", "abc"} {
+		if wait := budget.take(budget.bucketKey(workspace)); wait != 0 {
+			t.Fatalf("request %d waits %v", i, wait)
+		}
+	}
+	// The UUID with and without braces is one workspace
+	if wait := budget.take(budget.bucketKey("{abc}")); wait <= 0 || wait > 30*time.Minute {
+		t.Errorf("third request waits %v, want up to half an hour", wait)
+	}
+	if wait := budget.take(budget.bucketKey("other")); wait != 0 {
+		t.Errorf("other workspace waits %v", wait)
+	}
+
+	// Tokens come back at limit per hour
+	budget.buckets["abc"].updateAt = time.Now().Add(-31 * time.Minute)
+	if wait := budget.take(budget.bucketKey("abc")); wait != 0 {
+		t.Errorf("request after the refill waits %v", wait)
+	}
+
+	if err := NewRequestBudget(0, "").Wait(httptest.NewRequest("GET", "/", nil), "abc"); err != nil {
+		t.Errorf("disabled budget = %v", err)
+	}
+}
@@ -0,0 +1,261 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// ReviewerConfig picks the reviewers of cascade pull requests, as written in the config file. Missing
+// fields inherit, groups are merged by name.
+type ReviewerConfig struct {
+	// Author adds the author of the original pull request
+	Author *bool `json:"author" yaml:"author"`
+	// Approvers adds the users who approved the original pull request
+	Approvers *bool `json:"approvers" yaml:"approvers"`
+	// CodeOwners adds the owners of the changed files, read from the CODEOWNERS file of the destination branch
+	CodeOwners     *bool  `json:"codeowners" yaml:"codeowners"`
+	CodeOwnersPath string `json:"codeowners_path" yaml:"codeowners_path"`
+	// Groups are named lists of user IDs (account IDs or {UUID}s), for the stage reviewers and CODEOWNERS
+	Groups map[string][]string `json:"groups" yaml:"groups"`
+}
+
+// ReviewerSettings is the resolved ReviewerConfig of a repository
+type ReviewerSettings struct {
+	Author         bool
+	Approvers      bool
+	CodeOwners     bool
+	CodeOwnersPath string
+	Groups         map[string][]string
+}
+
+func (settings ReviewerSettings) overlay(config *ReviewerConfig) ReviewerSettings {
+	if config == nil {
+		return settings
+	}
+	if config.Author != nil {
+		settings.Author = *config.Author
+	}
+	if config.Approvers != nil {
+		settings.Approvers = *config.Approvers
+	}
+	if config.CodeOwners != nil {
+		settings.CodeOwners = *config.CodeOwners
+	}
+	if config.CodeOwnersPath != "" {
+		settings.CodeOwnersPath = config.CodeOwnersPath
+	}
+	if len(config.Groups) > 0 {
+		groups := make(map[string][]string, len(settings.Groups)+len(config.Groups))
+		for name, members := range settings.Groups {
+			groups[name] = members
+		}
+		for name, members := range config.Groups {
+			groups[name] = members
+		}
+		settings.Groups = groups
+	}
+	return settings
+}
+
+var userIdPattern = regexp.MustCompile(`^(\{[^}]+\}|[0-9]+:[0-9a-fA-F-]+|[0-9a-f]{24})$`)
+
+// expand resolves a reviewer group name or user ID, with or without a leading "@", into user IDs
+func (settings ReviewerSettings) expand(reviewer string) []string {
+	reviewer = strings.TrimPrefix(reviewer, "@")
+	if members, ok := settings.Groups[reviewer]; ok {
+		return members
+	}
+	if userIdPattern.MatchString(reviewer) {
+		return []string{reviewer}
+	}
+	log.Println("SKIP reviewer (not a group nor a user ID) -> ", reviewer)
+	return nil
+}
+
+// ownerID returns the account ID of a user, or the UUID when the account ID is unknown
+func ownerID(owner Owner) string {
+	if owner.AccountId != "" {
+		return owner.AccountId
+	}
+	return owner.UUID
+}
+
+// currentUser caches the account of the bot, it can't review its own pull requests
+type currentUser struct {
+	mu   sync.Mutex
+	user *Owner
+}
+
+func (service *BitbucketService) currentUser() (*Owner, error) {
+	service.self.mu.Lock()
+	defer service.self.mu.Unlock()
+
+	if service.self.user == nil {
+		user, err := service.bitbucketAPI.CurrentUser()
+		if err != nil {
+			return nil, err
+		}
+		service.self.user = user
+	}
+	return service.self.user, nil
+}
+
+// withoutBot removes the bot, duplicates and blanks from reviewers. When the bot can't be looked up
+// the reviewers are returned without the bot filter along with the error.
+func (service *BitbucketService) withoutBot(reviewers []string) ([]string, error) {
+	seen := map[string]bool{"": true}
+	bot, err := service.currentUser()
+	if err == nil {
+		seen[bot.AccountId] = true
+		seen[bot.UUID] = true
+	}
+	var filtered []string
+	for _, reviewer := range reviewers {
+		if !seen[reviewer] {
+			seen[reviewer] = true
+			filtered = append(filtered, reviewer)
+		}
+	}
+	return filtered, err
+}
+
+/*** REVIEWERS -> ORIGINAL AUTHOR, APPROVERS, STAGE & CODE OWNERS ***/
+/* ================================================================ */
+
+// CascadeReviewers returns the reviewers of a cascade pull request into dest: the author and the
+// approvers of the original pull request and the reviewers of the stage, as configured. On error the
+// reviewers are still returned, only the bot may not have been filtered out.
+func (service *BitbucketService) CascadeReviewers(settings *RepositorySettings, dest string, origin CascadeOrigin) ([]string, error) {
+	var reviewers []string
+	if settings.Reviewers.Author {
+		reviewers = append(reviewers, ownerID(origin.Author))
+	}
+	if settings.Reviewers.Approvers {
+		for _, approver := range origin.Approvers {
+			reviewers = append(reviewers, ownerID(approver))
+		}
+	}
+	if stage := settings.ParseBranch(dest).Stage; stage != nil {
+		for _, reviewer := range stage.Reviewers {
+			reviewers = append(reviewers, settings.Reviewers.expand(reviewer)...)
+		}
+	}
+	return service.withoutBot(reviewers)
+}
+
+// AddCodeOwners adds the code owners of the files changed by a newly created pull request to its reviewers
+func (service *BitbucketService) AddCodeOwners(settings *RepositorySettings, repoOwner string, repoName string, pr *PullRequest, reviewers []string) error {
+	log.Println("--------- START AddCodeOwners ---------")
+
+	// Planned pull requests don't exist yet
+	if !settings.Reviewers.CodeOwners || pr.ID <= 0 {
+		return nil
+	}
+
+	owners, err := service.CodeOwners(settings, repoOwner, repoName, pr)
+	if err != nil {
+		return err
+	}
+	all, err := service.withoutBot(append(append([]string(nil), reviewers...), owners...))
+	if err != nil {
+		return err
+	}
+	if len(all) == len(reviewers) {
+		log.Println("No code owners to add -> ", pr.ID)
+		return nil
+	}
+
+	log.Println("Code owners of PR ", pr.ID, " -> ", all[len(reviewers):])
+	err = service.bitbucketAPI.UpdatePullRequest(repoOwner, repoName, pr.ID, PullRequestUpdate{Reviewers: all})
+
+	log.Println("--------- End AddCodeOwners ---------")
+	return err
+}
+
+// CodeOwners returns the owners of the files changed by the pull request, read from the CODEOWNERS file of
+// its destination branch. The last rule matching a file wins. Owners are reviewer group names ("@qa-team")
+// or user IDs ("@{uuid}"), other owners are skipped.
+func (service *BitbucketService) CodeOwners(settings *RepositorySettings, repoOwner string, repoName string, pr *PullRequest) ([]string, error) {
+	ref := pr.Destination.Commit.Hash
+	if ref == "" {
+		ref = pr.Destination.Branch.Name
+	}
+	content, err := service.bitbucketAPI.GetFileContent(repoOwner, repoName, ref, settings.Reviewers.CodeOwnersPath)
+	var upstream *UpstreamError
+	if errors.As(err, &upstream) && upstream.StatusCode == http.StatusNotFound {
+		log.Println("No code owners file -> ", settings.Reviewers.CodeOwnersPath, ref)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rules := parseCodeOwners(content)
+
+	diffStats, err := service.bitbucketAPI.GetDiffStat(repoOwner, repoName, pr.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var owners []string
+	for _, diffStat := range diffStats {
+		path := diffStat.Path()
+		for i := len(rules) - 1; i >= 0; i-- {
+			if rules[i].pattern.MatchString(path) {
+				for _, owner := range rules[i].owners {
+					owners = append(owners, settings.Reviewers.expand(owner)...)
+				}
+				break
+			}
+		}
+	}
+	return owners, nil
+}
+
+type codeOwnersRule struct {
+	pattern *regexp.Regexp
+	owners  []string
+}
+
+// parseCodeOwners reads "<pattern> <owner>..." lines, skipping comments and invalid patterns
+func parseCodeOwners(content []byte) []codeOwnersRule {
+	var rules []codeOwnersRule
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		pattern, err := compileCodeOwnersPattern(fields[0])
+		if err != nil {
+			log.Println("SKIP code owners rule -> ", line, err)
+			continue
+		}
+		rules = append(rules, codeOwnersRule{pattern: pattern, owners: fields[1:]})
+	}
+	return rules
+}
+
+// compileCodeOwnersPattern turns a gitignore style pattern into a regexp: "*" matches within a directory,
+// "**" across directories, patterns starting with or containing "/" are anchored to the root and a
+// pattern matching a directory matches everything below it
+func compileCodeOwnersPattern(pattern string) (*regexp.Regexp, error) {
+	anchored := strings.Contains(strings.TrimSuffix(pattern, "/"), "/")
+	pattern = strings.Trim(pattern, "/")
+
+	expr := regexp.QuoteMeta(pattern)
+	expr = strings.ReplaceAll(expr, `\*\*`, "\x00")
+	expr = strings.ReplaceAll(expr, `\*`, "[^/]*")
+	expr = strings.ReplaceAll(expr, `\?`, "[^/]")
+	expr = strings.ReplaceAll(expr, "\x00", ".*")
+	if !anchored {
+		expr = "(?:.*/)?" + expr
+	}
+	return regexp.Compile("^" + expr + "(?:/.*)?$")
+}
@@ -0,0 +1,120 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompileCodeOwnersPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		match   bool
+	}{
+		{"*.go", "main.go", true},
+		{"*.go", "internal/reviewers.go", true},
+		{"*.go", "main.go.txt", false},
+		{"docs/", "docs/README.md", true},
+		{"docs/", "internal/docs/README.md", true},
+		{"/docs/", "internal/docs/README.md", false},
+		{"internal/*.go", "internal/reviewers.go", true},
+		{"internal/*.go", "internal/sub/reviewers.go", false},
+		{"internal/**/*.go", "internal/sub/reviewers.go", true},
+		{"internal", "internal/sub/reviewers.go", true},
+		{"go.?od", "go.mod", true},
+		{"a+b.txt", "a+b.txt", true},
+		{"a+b.txt", "aab.txt", false},
+	}
+	for _, test := range tests {
+		matcher, err := compileCodeOwnersPattern(test.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := matcher.MatchString(test.path); got != test.match {
+			t.Errorf("%q matches %q = %v, want %v", test.pattern, test.path, got, test.match)
+		}
+	}
+}
+
+func TestCodeOwners(t *testing.T) {
+	codeOwners := `# Owners of the repository
+*            @backend
+*.md         @{writer}
+docs/        @qa-team
+/go.mod      @backend 557058:c0ffee00-0000-4000-8000-000000000000
+internal/    not-an-owner
+`
+
+	tests := []struct {
+		name  string
+		files []string
+		want  []string
+	}{
+		{name: "default rule", files: []string{"main.go"}, want: []string{"{backend}"}},
+		// The last matching rule wins, docs/ over *.md over *
+		{name: "last match wins", files: []string{"docs/guide.md"}, want: []string{"{qa}", "{tester}"}},
+		{name: "earlier rule", files: []string{"README.md"}, want: []string{"{writer}"}},
+		{name: "anchored rule", files: []string{"go.mod", "tools/go.mod"}, want: []string{"{backend}", "557058:c0ffee00-0000-4000-8000-000000000000", "{backend}"}},
+		{name: "owners that aren't users", files: []string{"internal/reviewers.go"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			service, fake := newTestService(t, &CascadeFile{RepositoryConfig: RepositoryConfig{Reviewers: &ReviewerConfig{
+				Groups: map[string][]string{"backend": {"{backend}"}, "qa-team": {"{qa}", "{tester}"}},
+			}}})
+			settings := service.Registry.For(testOwner + "/" + testSlug)
+			fake.SetFile(testOwner, testSlug, "CODEOWNERS", codeOwners)
+			fake.SetCommitFiles(testOwner, testSlug, "feature1", test.files...)
+			pr := createCascade(t, fake)
+
+			owners, err := service.CodeOwners(settings, testOwner, testSlug, pr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(owners, test.want) {
+				t.Errorf("CodeOwners() = %q, want %q", owners, test.want)
+			}
+		})
+	}
+}
+
+func TestCodeOwnersWithoutTheFile(t *testing.T) {
+	service, fake := newTestService(t, nil)
+	settings := service.Registry.For(testOwner + "/" + testSlug)
+	fake.SetCommitFiles(testOwner, testSlug, "feature1", "main.go")
+	pr := createCascade(t, fake)
+
+	owners, err := service.CodeOwners(settings, testOwner, testSlug, pr)
+	if err != nil || owners != nil {
+		t.Errorf("CodeOwners() = %q, %v, want none", owners, err)
+	}
+}
+
+func TestWithoutBot(t *testing.T) {
+	tests := []struct {
+		name      string
+		reviewers []string
+		down      bool
+		want      []string
+	}{
+		{name: "bot by account ID", reviewers: []string{"alice", "cascade-bot", "bob"}, want: []string{"alice", "bob"}},
+		{name: "bot by UUID", reviewers: []string{"{cascade-bot}", "alice"}, want: []string{"alice"}},
+		{name: "duplicates and blanks", reviewers: []string{"alice", "", "bob", "alice"}, want: []string{"alice", "bob"}},
+		{name: "bot unknown", reviewers: []string{"alice", "cascade-bot", "alice"}, down: true, want: []string{"alice", "cascade-bot"}},
+		{name: "none", reviewers: []string{"cascade-bot"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			service, fake := newTestService(t, nil)
+			fake.SetCurrentUserDown(test.down)
+
+			got, err := service.withoutBot(test.reviewers)
+			if (err != nil) != test.down {
+				t.Errorf("withoutBot() err = %v, want err %v", err, test.down)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("withoutBot() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}